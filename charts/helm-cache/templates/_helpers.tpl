@@ -60,3 +60,47 @@ Create the name of the service account to use
 {{- default "default" .Values.serviceAccount.name }}
 {{- end }}
 {{- end }}
+
+{{/*
+RBAC rules to read helm releases
+*/}}
+{{- define "helm-cache.rbacRules" -}}
+- apiGroups:
+  - ""
+  resources:
+  {{- if has "secret" .Values.helmDrivers }}
+  - secrets
+  {{- end }}
+  {{- if or (has "configmap" .Values.helmDrivers) (has "tiller" .Values.helmDrivers) }}
+  - configmaps
+  {{- end }}
+  verbs:
+  - get
+  - list
+  - watch
+{{- if .Values.gitopsDiscovery }}
+- apiGroups:
+  - helm.toolkit.fluxcd.io
+  resources:
+  - helmreleases
+  verbs:
+  - get
+  - list
+- apiGroups:
+  - source.toolkit.fluxcd.io
+  resources:
+  - helmrepositories
+  - gitrepositories
+  - buckets
+  verbs:
+  - get
+  - list
+- apiGroups:
+  - argoproj.io
+  resources:
+  - applications
+  verbs:
+  - get
+  - list
+{{- end }}
+{{- end }}
@@ -4,15 +4,27 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"github.com/turboazot/helm-cache/pkg/entities"
 	"github.com/turboazot/helm-cache/pkg/services"
+	"github.com/turboazot/helm-cache/pkg/utils"
 	"go.uber.org/zap"
+	"k8s.io/client-go/kubernetes"
 )
 
+// clusters are read from the config file only, as they can't be expressed with flags
+var clusters []entities.ClusterConfig
+
+// chartmuseums are additional Chartmuseums read from the config file only
+var chartmuseums []entities.ChartmuseumConfig
+
 func runRootCommand(cmd *cobra.Command, args []string) {
 	var err error
 	var kubeconfigPath string
@@ -30,16 +42,183 @@ func runRootCommand(cmd *cobra.Command, args []string) {
 		zap.L().Sugar().Fatalf("Fail to get chartmuseum password: %v", err)
 	}
 
+	chartmuseumPasswordFile, err := cmd.Flags().GetString("chartmuseumPasswordFile")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get chartmuseum password file: %v", err)
+	}
+	chartmuseumPasswordSecret, err := cmd.Flags().GetString("chartmuseumPasswordSecret")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get chartmuseum password secret: %v", err)
+	}
+	chartmuseumToken, err := cmd.Flags().GetString("chartmuseumToken")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get chartmuseum token: %v", err)
+	}
+	chartmuseumTokenFile, err := cmd.Flags().GetString("chartmuseumTokenFile")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get chartmuseum token file: %v", err)
+	}
+	chartmuseumTokenSecret, err := cmd.Flags().GetString("chartmuseumTokenSecret")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get chartmuseum token secret: %v", err)
+	}
+	chartmuseumHeaders, err := cmd.Flags().GetStringToString("chartmuseumHeaders")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get chartmuseum headers: %v", err)
+	}
+
+	chartmuseumRefreshInterval, err := cmd.Flags().GetDuration("chartmuseumRefreshInterval")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get chartmuseum refresh interval: %v", err)
+	}
+
+	tlsCAFile, err := cmd.Flags().GetString("tlsCAFile")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get TLS CA file: %v", err)
+	}
+	tlsCertFile, err := cmd.Flags().GetString("tlsCertFile")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get TLS certificate file: %v", err)
+	}
+	tlsKeyFile, err := cmd.Flags().GetString("tlsKeyFile")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get TLS key file: %v", err)
+	}
+	tlsInsecureSkipVerify, err := cmd.Flags().GetBool("tlsInsecureSkipVerify")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get TLS insecure skip verify value: %v", err)
+	}
+
+	ociRepositories, err := cmd.Flags().GetStringSlice("ociRepositories")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get OCI repositories: %v", err)
+	}
+	ociUsername, err := cmd.Flags().GetString("ociUsername")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get OCI username: %v", err)
+	}
+	ociPassword, err := cmd.Flags().GetString("ociPassword")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get OCI password: %v", err)
+	}
+	ociCredentialsFile, err := cmd.Flags().GetString("ociCredentialsFile")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get OCI credentials file: %v", err)
+	}
+	ociInsecure, err := cmd.Flags().GetBool("ociInsecure")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get OCI insecure value: %v", err)
+	}
+
+	s3Endpoint, err := cmd.Flags().GetString("s3Endpoint")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get S3 endpoint: %v", err)
+	}
+	s3Bucket, err := cmd.Flags().GetString("s3Bucket")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get S3 bucket: %v", err)
+	}
+	s3Prefix, err := cmd.Flags().GetString("s3Prefix")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get S3 prefix: %v", err)
+	}
+	s3Region, err := cmd.Flags().GetString("s3Region")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get S3 region: %v", err)
+	}
+	s3AccessKey, err := cmd.Flags().GetString("s3AccessKey")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get S3 access key: %v", err)
+	}
+	s3SecretKey, err := cmd.Flags().GetString("s3SecretKey")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get S3 secret key: %v", err)
+	}
+	s3Insecure, err := cmd.Flags().GetBool("s3Insecure")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get S3 insecure value: %v", err)
+	}
+
+	localDirectory, err := cmd.Flags().GetString("localDirectory")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get local directory: %v", err)
+	}
+
+	conflictPolicy, err := cmd.Flags().GetString("conflictPolicy")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get conflict policy: %v", err)
+	}
+
+	verifyCharts, err := cmd.Flags().GetBool("verifyCharts")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get verify charts value: %v", err)
+	}
+
+	metricsAddress, err := cmd.Flags().GetString("metricsAddress")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get metrics address: %v", err)
+	}
+
+	serverAddress, err := cmd.Flags().GetString("serverAddress")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get server address: %v", err)
+	}
+
 	scanningInterval, err := cmd.Flags().GetDuration("scanningInterval")
 	if err != nil {
 		zap.L().Sugar().Fatalf("Fail to get scanning interval: %v", err)
 	}
 
+	watch, err := cmd.Flags().GetBool("watch")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get watch value: %v", err)
+	}
+
+	resyncInterval, err := cmd.Flags().GetDuration("resyncInterval")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get resync interval: %v", err)
+	}
+
 	homeDirectory, err := cmd.Flags().GetString("homeDirectory")
 	if err != nil {
 		zap.L().Sugar().Fatalf("Fail to get home directory value: %v", err)
 	}
 
+	helmDrivers, err := cmd.Flags().GetStringSlice("helmDrivers")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get helm drivers value: %v", err)
+	}
+
+	sqlConnectionString, err := cmd.Flags().GetString("sqlConnectionString")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get SQL connection string: %v", err)
+	}
+
+	namespaces, err := cmd.Flags().GetStringSlice("namespaces")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get namespaces value: %v", err)
+	}
+
+	excludeNamespaces, err := cmd.Flags().GetStringSlice("excludeNamespaces")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get exclude namespaces value: %v", err)
+	}
+
+	allRevisions, err := cmd.Flags().GetBool("allRevisions")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get all revisions value: %v", err)
+	}
+
+	releaseStatuses, err := cmd.Flags().GetStringSlice("releaseStatuses")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get release statuses value: %v", err)
+	}
+
+	gitopsDiscovery, err := cmd.Flags().GetBool("gitopsDiscovery")
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to get GitOps discovery value: %v", err)
+	}
+
 	inclusterConfig, err := cmd.Flags().GetBool("inclusterConfig")
 	if err != nil {
 		zap.L().Sugar().Fatalf("Fail to get in-cluster config value: %v", err)
@@ -53,26 +232,143 @@ func runRootCommand(cmd *cobra.Command, args []string) {
 		}
 	}
 
-	helmClient, err := services.NewHelmClient(homeDirectory)
+	helmClient, err := services.NewHelmClient(homeDirectory, ociCredentialsFile)
 	if err != nil {
 		zap.L().Sugar().Fatalf("Fail to initialize helm client: %v", err)
 	}
 
-	chartmuseumClient, err := services.NewChartmuseumClient(chartmuseumUrl, chartmuseumUsername, chartmuseumPassword)
+	// The Helm registry client can't use custom TLS settings, OCI registries would silently ignore them
+	if len(ociRepositories) > 0 && (tlsCAFile != "" || tlsCertFile != "" || tlsKeyFile != "" || tlsInsecureSkipVerify) {
+		zap.L().Sugar().Fatal("Fail to apply TLS options: they can't be combined with ociRepositories, OCI registries only use system certificates")
+	}
+
+	tlsConfig, err := utils.NewTLSConfig(tlsCAFile, tlsCertFile, tlsKeyFile, tlsInsecureSkipVerify)
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to load TLS configuration: %v", err)
+	}
+	if tlsInsecureSkipVerify {
+		zap.L().Sugar().Info("TLS certificates of chart stores aren't verified")
+	}
+
+	if len(clusters) == 0 {
+		clusters = []entities.ClusterConfig{
+			{
+				KubeconfigPath: kubeconfigPath,
+				InCluster:      kubeconfigPath == "",
+			},
+		}
+	}
+
+	var chartStores []services.ChartStore
+
+	if chartmuseumUrl != "" {
+		chartmuseums = append([]entities.ChartmuseumConfig{{
+			Url:            chartmuseumUrl,
+			Username:       chartmuseumUsername,
+			Password:       chartmuseumPassword,
+			PasswordFile:   chartmuseumPasswordFile,
+			PasswordSecret: chartmuseumPasswordSecret,
+			Token:          chartmuseumToken,
+			TokenFile:      chartmuseumTokenFile,
+			TokenSecret:    chartmuseumTokenSecret,
+			Headers:        chartmuseumHeaders,
+		}}, chartmuseums...)
+	}
+	for _, chartmuseum := range chartmuseums {
+		chartmuseumAuth, err := newChartmuseumAuth(chartmuseum, clusters)
+		if err != nil {
+			zap.L().Sugar().Fatalf("Fail to initialize %s chartmuseum credentials: %v", chartmuseum.Url, err)
+		}
+
+		chartmuseumClient, err := services.NewChartmuseumClient(chartmuseum.Url, chartmuseumAuth, chartmuseumRefreshInterval, tlsConfig)
+		if err != nil {
+			zap.L().Sugar().Fatalf("Fail to initialize %s chartmuseum client: %v", chartmuseum.Url, err)
+		}
+		if chartmuseumClient.IsActive() {
+			chartStores = append(chartStores, chartmuseumClient)
+		}
+	}
+
+	ociClient, err := services.NewOCIClient(helmClient.ActionConfig.RegistryClient, ociRepositories, ociUsername, ociPassword, ociInsecure)
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to initialize OCI client: %v", err)
+	}
+
+	objectStorageClient, err := services.NewObjectStorageClient(s3Endpoint, s3Bucket, s3Prefix, s3Region, s3AccessKey, s3SecretKey, s3Insecure, tlsConfig)
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to initialize object storage client: %v", err)
+	}
+
+	localChartStore, err := services.NewLocalChartStore(localDirectory)
+	if err != nil {
+		zap.L().Sugar().Fatalf("Fail to initialize local chart store: %v", err)
+	}
+
+	if ociClient.IsActive() {
+		chartStores = append(chartStores, ociClient)
+	}
+	if objectStorageClient.IsActive() {
+		chartStores = append(chartStores, objectStorageClient)
+	}
+	if localChartStore.IsActive() {
+		chartStores = append(chartStores, localChartStore)
+	}
+
+	// The repository cache of the pod is empty, subcharts of Helm v3 releases are mostly found in chart stores
+	helmClient.ChartStores = chartStores
+
+	namespaceFilter := entities.NewNamespaceFilter(namespaces, excludeNamespaces)
+	releaseSources, err := services.NewReleaseSources(helmClient, clusters, helmDrivers, sqlConnectionString, namespaceFilter)
 	if err != nil {
-		zap.L().Sugar().Fatalf("Fail to initialize chartmuseum client: %v", err)
+		zap.L().Sugar().Fatalf("Fail to initialize release sources: %v", err)
+	}
+
+	var gitOpsClients map[string]*services.GitOpsClient
+	if gitopsDiscovery {
+		gitOpsClients = services.NewGitOpsClients(clusters, namespaceFilter)
 	}
 
-	c, err := services.NewCollector(helmClient, chartmuseumClient, kubeconfigPath)
+	c, err := services.NewCollector(helmClient, chartStores, conflictPolicy, verifyCharts, releaseSources, allRevisions, releaseStatuses, gitOpsClients, resyncInterval)
 	if err != nil {
 		zap.L().Sugar().Fatalf("Fail to initialize collector: %v", err)
 	}
 
+	if metricsAddress != "" {
+		go func() {
+			if err := services.ServeMetrics(metricsAddress); err != nil {
+				zap.L().Sugar().Fatalf("Fail to serve metrics: %v", err)
+			}
+		}()
+	}
+
+	repositoryServer := services.NewRepositoryServer(helmClient.PackagedChartsDirectory, serverAddress)
+	if repositoryServer.IsActive() {
+		go func() {
+			if err := repositoryServer.ListenAndServe(); err != nil {
+				zap.L().Sugar().Fatalf("Fail to serve helm repository: %v", err)
+			}
+		}()
+	}
+
+	if watch {
+		stopCh := make(chan struct{})
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-signals
+			close(stopCh)
+		}()
+
+		zap.L().Sugar().Info("Watching helm releases...")
+		c.Watch(scanningInterval, resyncInterval, stopCh)
+		return
+	}
+
 	for {
-		zap.L().Sugar().Info("Checking all helm secrets...")
-		err = c.CheckAllSecrets()
+		zap.L().Sugar().Info("Checking all helm releases...")
+		err = c.CheckAllReleases()
 		if err != nil {
-			zap.L().Sugar().Fatalf("Fail to check helm secrets: %v", err)
+			zap.L().Sugar().Fatalf("Fail to check helm releases: %v", err)
 		}
 		zap.L().Sugar().Info("Checking finished!")
 		time.Sleep(scanningInterval)
@@ -94,11 +390,85 @@ func Execute() error {
 	rootCmd.PersistentFlags().StringP("chartmuseumUrl", "c", "", "Chartmuseum URL")
 	rootCmd.PersistentFlags().StringP("chartmuseumUsername", "u", "", "Chartmuseum username")
 	rootCmd.PersistentFlags().StringP("chartmuseumPassword", "p", "", "Chartmuseum password")
+	rootCmd.PersistentFlags().String("chartmuseumPasswordFile", "", "File with Chartmuseum password, it's read again when it changes")
+	rootCmd.PersistentFlags().String("chartmuseumPasswordSecret", "", "Kubernetes secret key with Chartmuseum password in namespace/name/key format")
+	rootCmd.PersistentFlags().String("chartmuseumToken", "", "Chartmuseum bearer token")
+	rootCmd.PersistentFlags().String("chartmuseumTokenFile", "", "File with Chartmuseum bearer token, it's read again when it changes")
+	rootCmd.PersistentFlags().String("chartmuseumTokenSecret", "", "Kubernetes secret key with Chartmuseum bearer token in namespace/name/key format")
+	rootCmd.PersistentFlags().StringToString("chartmuseumHeaders", map[string]string{}, "Extra headers of Chartmuseum requests, e.g. X-Auth-Key=value")
+	rootCmd.PersistentFlags().Duration("chartmuseumRefreshInterval", 10*time.Minute, "Interval between reloading lists of charts existing in Chartmuseums (0 disables reloading)")
+	rootCmd.PersistentFlags().String("tlsCAFile", "", "CA bundle to verify TLS certificates of Chartmuseums and object storage with (OCI registries use system certificates)")
+	rootCmd.PersistentFlags().String("tlsCertFile", "", "Client certificate for mutual TLS with Chartmuseums and object storage (not OCI registries)")
+	rootCmd.PersistentFlags().String("tlsKeyFile", "", "Client certificate key for mutual TLS with Chartmuseums and object storage (not OCI registries)")
+	rootCmd.PersistentFlags().Bool("tlsInsecureSkipVerify", false, "Don't verify TLS certificates of Chartmuseums and object storage (not OCI registries)")
+	rootCmd.PersistentFlags().StringSlice("ociRepositories", []string{}, "OCI repositories to push charts to, e.g. oci://ghcr.io/org/charts")
+	rootCmd.PersistentFlags().String("ociUsername", "", "OCI registry username")
+	rootCmd.PersistentFlags().String("ociPassword", "", "OCI registry password")
+	rootCmd.PersistentFlags().String("ociCredentialsFile", "", "OCI registry credentials file in docker config format (default is Helm registry config)")
+	rootCmd.PersistentFlags().Bool("ociInsecure", false, "Allow insecure connections to OCI registries on login")
+	rootCmd.PersistentFlags().String("s3Endpoint", "", "S3-compatible object storage endpoint, e.g. s3.amazonaws.com or minio:9000")
+	rootCmd.PersistentFlags().String("s3Bucket", "", "Bucket to store charts and index.yaml in")
+	rootCmd.PersistentFlags().String("s3Prefix", "", "Path prefix of charts and index.yaml in the bucket")
+	rootCmd.PersistentFlags().String("s3Region", "", "Bucket region")
+	rootCmd.PersistentFlags().String("s3AccessKey", "", "Object storage access key (default is taken from the environment)")
+	rootCmd.PersistentFlags().String("s3SecretKey", "", "Object storage secret key (default is taken from the environment)")
+	rootCmd.PersistentFlags().Bool("s3Insecure", false, "Connect to the object storage over plain HTTP")
+	rootCmd.PersistentFlags().String("localDirectory", "", "Directory to copy packaged charts to, e.g. a mounted network share")
+	rootCmd.PersistentFlags().String("conflictPolicy", "", "Compare digests of charts existing in chart stores with cached charts and resolve conflicts (skip, overwrite, rename)")
+	rootCmd.PersistentFlags().Bool("verifyCharts", false, "Render packaged charts with release values and compare them with release manifests")
+	rootCmd.PersistentFlags().String("metricsAddress", "", "Address to serve Prometheus metrics on, e.g. :9090 (disabled by default)")
+	rootCmd.PersistentFlags().String("serverAddress", "", "Address to serve packaged charts as a helm repository on, e.g. :8080 (disabled by default)")
 	rootCmd.PersistentFlags().DurationP("scanningInterval", "s", 10*time.Second, "Interval between scanning helm release secrets")
+	rootCmd.PersistentFlags().BoolP("watch", "w", false, "Watch helm releases with informers instead of periodic scanning")
+	rootCmd.PersistentFlags().DurationP("resyncInterval", "r", 10*time.Minute, "Interval between full resyncs of watched helm releases and reloading GitOps chart sources")
+	rootCmd.PersistentFlags().StringSlice("helmDrivers", []string{services.SecretDriver}, "Helm storage drivers to read releases from (secret, configmap, sql, tiller)")
+	rootCmd.PersistentFlags().String("sqlConnectionString", "", "PostgreSQL connection string of the Helm SQL storage driver")
+	rootCmd.PersistentFlags().StringSlice("namespaces", []string{}, "Namespaces to scan, glob patterns are supported (default is all namespaces)")
+	rootCmd.PersistentFlags().StringSlice("excludeNamespaces", []string{}, "Namespaces to skip, glob patterns are supported")
+	rootCmd.PersistentFlags().BoolP("allRevisions", "a", false, "Cache charts of all retained release revisions instead of the last one only")
+	rootCmd.PersistentFlags().Bool("gitopsDiscovery", false, "Read Flux HelmRelease and Argo CD Application resources to learn where charts come from")
+	rootCmd.PersistentFlags().StringSlice("releaseStatuses", []string{}, "Release statuses to cache charts of, e.g. deployed,superseded (default is all statuses)")
 	viper.BindPFlag("chartmuseumUrl", rootCmd.PersistentFlags().Lookup("chartmuseumUrl"))
 	viper.BindPFlag("chartmuseumUsername", rootCmd.PersistentFlags().Lookup("chartmuseumUsername"))
 	viper.BindPFlag("chartmuseumPassword", rootCmd.PersistentFlags().Lookup("chartmuseumPassword"))
+	viper.BindPFlag("chartmuseumPasswordFile", rootCmd.PersistentFlags().Lookup("chartmuseumPasswordFile"))
+	viper.BindPFlag("chartmuseumPasswordSecret", rootCmd.PersistentFlags().Lookup("chartmuseumPasswordSecret"))
+	viper.BindPFlag("chartmuseumToken", rootCmd.PersistentFlags().Lookup("chartmuseumToken"))
+	viper.BindPFlag("chartmuseumTokenFile", rootCmd.PersistentFlags().Lookup("chartmuseumTokenFile"))
+	viper.BindPFlag("chartmuseumTokenSecret", rootCmd.PersistentFlags().Lookup("chartmuseumTokenSecret"))
+	viper.BindPFlag("chartmuseumHeaders", rootCmd.PersistentFlags().Lookup("chartmuseumHeaders"))
+	viper.BindPFlag("chartmuseumRefreshInterval", rootCmd.PersistentFlags().Lookup("chartmuseumRefreshInterval"))
+	viper.BindPFlag("tlsCAFile", rootCmd.PersistentFlags().Lookup("tlsCAFile"))
+	viper.BindPFlag("tlsCertFile", rootCmd.PersistentFlags().Lookup("tlsCertFile"))
+	viper.BindPFlag("tlsKeyFile", rootCmd.PersistentFlags().Lookup("tlsKeyFile"))
+	viper.BindPFlag("tlsInsecureSkipVerify", rootCmd.PersistentFlags().Lookup("tlsInsecureSkipVerify"))
+	viper.BindPFlag("ociRepositories", rootCmd.PersistentFlags().Lookup("ociRepositories"))
+	viper.BindPFlag("ociUsername", rootCmd.PersistentFlags().Lookup("ociUsername"))
+	viper.BindPFlag("ociPassword", rootCmd.PersistentFlags().Lookup("ociPassword"))
+	viper.BindPFlag("ociCredentialsFile", rootCmd.PersistentFlags().Lookup("ociCredentialsFile"))
+	viper.BindPFlag("ociInsecure", rootCmd.PersistentFlags().Lookup("ociInsecure"))
+	viper.BindPFlag("s3Endpoint", rootCmd.PersistentFlags().Lookup("s3Endpoint"))
+	viper.BindPFlag("s3Bucket", rootCmd.PersistentFlags().Lookup("s3Bucket"))
+	viper.BindPFlag("s3Prefix", rootCmd.PersistentFlags().Lookup("s3Prefix"))
+	viper.BindPFlag("s3Region", rootCmd.PersistentFlags().Lookup("s3Region"))
+	viper.BindPFlag("s3AccessKey", rootCmd.PersistentFlags().Lookup("s3AccessKey"))
+	viper.BindPFlag("s3SecretKey", rootCmd.PersistentFlags().Lookup("s3SecretKey"))
+	viper.BindPFlag("s3Insecure", rootCmd.PersistentFlags().Lookup("s3Insecure"))
+	viper.BindPFlag("localDirectory", rootCmd.PersistentFlags().Lookup("localDirectory"))
+	viper.BindPFlag("conflictPolicy", rootCmd.PersistentFlags().Lookup("conflictPolicy"))
+	viper.BindPFlag("verifyCharts", rootCmd.PersistentFlags().Lookup("verifyCharts"))
+	viper.BindPFlag("metricsAddress", rootCmd.PersistentFlags().Lookup("metricsAddress"))
+	viper.BindPFlag("serverAddress", rootCmd.PersistentFlags().Lookup("serverAddress"))
 	viper.BindPFlag("scanningInterval", rootCmd.PersistentFlags().Lookup("scanningInterval"))
+	viper.BindPFlag("watch", rootCmd.PersistentFlags().Lookup("watch"))
+	viper.BindPFlag("resyncInterval", rootCmd.PersistentFlags().Lookup("resyncInterval"))
+	viper.BindPFlag("helmDrivers", rootCmd.PersistentFlags().Lookup("helmDrivers"))
+	viper.BindPFlag("sqlConnectionString", rootCmd.PersistentFlags().Lookup("sqlConnectionString"))
+	viper.BindPFlag("namespaces", rootCmd.PersistentFlags().Lookup("namespaces"))
+	viper.BindPFlag("excludeNamespaces", rootCmd.PersistentFlags().Lookup("excludeNamespaces"))
+	viper.BindPFlag("allRevisions", rootCmd.PersistentFlags().Lookup("allRevisions"))
+	viper.BindPFlag("releaseStatuses", rootCmd.PersistentFlags().Lookup("releaseStatuses"))
+	viper.BindPFlag("gitopsDiscovery", rootCmd.PersistentFlags().Lookup("gitopsDiscovery"))
 
 	return rootCmd.Execute()
 }
@@ -162,6 +532,14 @@ func initCommand(cmd *cobra.Command, args []string) error {
 		zap.L().Sugar().Infof("Using config file: %s", v.ConfigFileUsed())
 	}
 
+	if err := v.UnmarshalKey("clusters", &clusters); err != nil {
+		return err
+	}
+
+	if err := v.UnmarshalKey("chartmuseums", &chartmuseums); err != nil {
+		return err
+	}
+
 	return bindFlags(cmd, v)
 }
 
@@ -170,9 +548,82 @@ func bindFlags(cmd *cobra.Command, v *viper.Viper) error {
 	cmd.Flags().VisitAll(func(f *pflag.Flag) {
 		if !f.Changed && v.IsSet(f.Name) {
 			val := v.Get(f.Name)
+			if m, ok := val.(map[string]interface{}); ok {
+				items := make([]string, 0, len(m))
+				for key, item := range m {
+					items = append(items, fmt.Sprintf("%s=%v", key, item))
+				}
+				err = cmd.Flags().Set(f.Name, strings.Join(items, ","))
+				return
+			}
+			if list, ok := val.([]interface{}); ok {
+				items := make([]string, len(list))
+				for i, item := range list {
+					items[i] = fmt.Sprintf("%v", item)
+				}
+				err = cmd.Flags().Set(f.Name, strings.Join(items, ","))
+				return
+			}
 			err = cmd.Flags().Set(f.Name, fmt.Sprintf("%v", val))
 		}
 	})
 
 	return err
 }
+
+// newChartmuseumAuth creates Chartmuseum credentials. Secrets with credentials are read from the
+// first cluster, the client is created only when a secret is referenced.
+func newChartmuseumAuth(chartmuseum entities.ChartmuseumConfig, clusters []entities.ClusterConfig) (services.ChartmuseumAuth, error) {
+	var clientset kubernetes.Interface
+	if chartmuseum.PasswordSecret != "" || chartmuseum.TokenSecret != "" {
+		var err error
+		clientset, err = newSecretsClientset(chartmuseum.Cluster, clusters)
+		if err != nil {
+			return services.ChartmuseumAuth{}, err
+		}
+	}
+
+	password, err := services.NewSecretValue(chartmuseum.Password, chartmuseum.PasswordFile, chartmuseum.PasswordSecret, clientset)
+	if err != nil {
+		return services.ChartmuseumAuth{}, err
+	}
+	token, err := services.NewSecretValue(chartmuseum.Token, chartmuseum.TokenFile, chartmuseum.TokenSecret, clientset)
+	if err != nil {
+		return services.ChartmuseumAuth{}, err
+	}
+
+	return services.ChartmuseumAuth{
+		Username: chartmuseum.Username,
+		Password: password,
+		Token:    token,
+		Headers:  chartmuseum.Headers,
+	}, nil
+}
+
+// newSecretsClientset creates a client of the named cluster to read credential secrets with. Without
+// a name the first cluster which can be connected to is used, so an unreachable cluster is skipped.
+func newSecretsClientset(clusterName string, clusters []entities.ClusterConfig) (kubernetes.Interface, error) {
+	if clusterName != "" {
+		for _, cluster := range clusters {
+			if cluster.Name == clusterName {
+				return services.NewKubernetesClientset(cluster)
+			}
+		}
+		return nil, errors.New(fmt.Sprintf("Cluster %s isn't configured", clusterName))
+	}
+
+	for _, cluster := range clusters {
+		clientset, err := services.NewKubernetesClientset(cluster)
+		if err == nil {
+			_, err = clientset.Discovery().ServerVersion()
+		}
+		if err != nil {
+			zap.L().Sugar().Infof("Can't connect to %s cluster to read secrets: %v", cluster.Name, err)
+			continue
+		}
+
+		return clientset, nil
+	}
+
+	return nil, errors.New("None of clusters can be connected to")
+}
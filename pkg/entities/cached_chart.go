@@ -0,0 +1,75 @@
+package entities
+
+// CachedChart keeps information about releases a locally cached chart has been found in.
+type CachedChart struct {
+	Name     string               `yaml:"name"`
+	Version  string               `yaml:"version"`
+	Releases []CachedChartRelease `yaml:"releases"`
+	Sources  []ChartSource        `yaml:"sources,omitempty"`
+	// Destinations keep the upload status of the chart in every chart store
+	Destinations []CachedChartDestination `yaml:"destinations,omitempty"`
+}
+
+type CachedChartRelease struct {
+	Cluster   string `yaml:"cluster,omitempty"`
+	Driver    string `yaml:"driver"`
+	Namespace string `yaml:"namespace"`
+	Name      string `yaml:"name"`
+	Revision  int    `yaml:"revision"`
+	Status    string `yaml:"status"`
+	// Verification is the result of rendering the cached chart with the release values (passed, failed)
+	Verification string `yaml:"verification,omitempty"`
+	// Mismatches are resources rendered differently than they are deployed by the release
+	Mismatches []string `yaml:"mismatches,omitempty"`
+}
+
+type CachedChartDestination struct {
+	Name     string `yaml:"name"`
+	Uploaded bool   `yaml:"uploaded"`
+	Error    string `yaml:"error,omitempty"`
+	// Conflict is set when the store keeps different contents under the same chart version
+	Conflict bool `yaml:"conflict,omitempty"`
+}
+
+func NewCachedChart(name string, version string) *CachedChart {
+	return &CachedChart{
+		Name:    name,
+		Version: version,
+	}
+}
+
+// SetRelease adds the release revision or updates it if it's already known.
+func (c *CachedChart) SetRelease(release CachedChartRelease) {
+	for index, r := range c.Releases {
+		if r.Cluster == release.Cluster && r.Driver == release.Driver && r.Namespace == release.Namespace && r.Name == release.Name && r.Revision == release.Revision {
+			c.Releases[index] = release
+			return
+		}
+	}
+
+	c.Releases = append(c.Releases, release)
+}
+
+// SetSource adds the chart source unless the same repository and chart is already known.
+func (c *CachedChart) SetSource(source ChartSource) {
+	for index, s := range c.Sources {
+		if s.Tool == source.Tool && s.RepoURL == source.RepoURL && s.Chart == source.Chart {
+			c.Sources[index] = source
+			return
+		}
+	}
+
+	c.Sources = append(c.Sources, source)
+}
+
+// SetDestination adds the upload status of the chart store or updates it if it's already known.
+func (c *CachedChart) SetDestination(destination CachedChartDestination) {
+	for index, d := range c.Destinations {
+		if d.Name == destination.Name {
+			c.Destinations[index] = destination
+			return
+		}
+	}
+
+	c.Destinations = append(c.Destinations, destination)
+}
@@ -0,0 +1,27 @@
+package entities
+
+import "fmt"
+
+// ChartSource is the origin of a chart as declared by a GitOps tool resource.
+type ChartSource struct {
+	Tool             string `yaml:"tool"`
+	Kind             string `yaml:"kind"`
+	Namespace        string `yaml:"namespace"`
+	Name             string `yaml:"name"`
+	ReleaseNamespace string `yaml:"releaseNamespace"`
+	StorageNamespace string `yaml:"storageNamespace,omitempty"`
+	ReleaseName      string `yaml:"releaseName"`
+	RepoURL          string `yaml:"repoURL"`
+	Chart            string `yaml:"chart"`
+	Version          string `yaml:"version,omitempty"`
+}
+
+// ReleaseKey identifies the Helm release the chart is installed as by the namespace of its resources.
+func (s *ChartSource) ReleaseKey() string {
+	return fmt.Sprintf("%s/%s", s.ReleaseNamespace, s.ReleaseName)
+}
+
+// StorageKey identifies the Helm release the chart is installed as by the namespace its revisions are stored in.
+func (s *ChartSource) StorageKey() string {
+	return fmt.Sprintf("%s/%s", s.StorageNamespace, s.ReleaseName)
+}
@@ -0,0 +1,17 @@
+package entities
+
+// ChartmuseumConfig describes one of the Chartmuseums charts are uploaded to.
+// Password and token can be given inline, in a file or as a namespace/name/key reference to a Kubernetes secret.
+// Secrets are read from Cluster, or from the first cluster which can be connected to when it's empty.
+type ChartmuseumConfig struct {
+	Url            string            `mapstructure:"url"`
+	Username       string            `mapstructure:"username"`
+	Password       string            `mapstructure:"password"`
+	PasswordFile   string            `mapstructure:"passwordFile"`
+	PasswordSecret string            `mapstructure:"passwordSecret"`
+	Token          string            `mapstructure:"token"`
+	TokenFile      string            `mapstructure:"tokenFile"`
+	TokenSecret    string            `mapstructure:"tokenSecret"`
+	Headers        map[string]string `mapstructure:"headers"`
+	Cluster        string            `mapstructure:"cluster"`
+}
@@ -0,0 +1,9 @@
+package entities
+
+// ClusterConfig describes how to connect to one of the scanned Kubernetes clusters.
+type ClusterConfig struct {
+	Name           string `mapstructure:"name"`
+	KubeconfigPath string `mapstructure:"kubeconfigPath"`
+	Context        string `mapstructure:"context"`
+	InCluster      bool   `mapstructure:"inCluster"`
+}
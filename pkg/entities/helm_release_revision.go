@@ -0,0 +1,66 @@
+package entities
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// HelmReleaseRevision describes a single stored revision of a Helm release without its payload.
+type HelmReleaseRevision struct {
+	Cluster     string
+	Driver      string
+	Namespace   string
+	ReleaseName string
+	Revision    int
+	Status      string
+	ObjectName  string
+}
+
+// NewHelmReleaseRevision creates a release revision from metadata of a secret or configmap
+// that has been written by the Helm storage driver.
+func NewHelmReleaseRevision(cluster string, driver string, m *metav1.PartialObjectMetadata) (*HelmReleaseRevision, error) {
+	rev := &HelmReleaseRevision{
+		Cluster:    cluster,
+		Driver:     driver,
+		Namespace:  m.Namespace,
+		Status:     m.Labels["status"],
+		ObjectName: m.Name,
+	}
+
+	if releaseName, releaseRevision := m.Labels["name"], m.Labels["version"]; releaseName != "" && releaseRevision != "" {
+		revision, err := strconv.Atoi(releaseRevision)
+		if err != nil {
+			return nil, err
+		}
+		rev.ReleaseName = releaseName
+		rev.Revision = revision
+		return rev, nil
+	}
+
+	objectNameSplitted := strings.Split(m.Name, ".")
+	if len(objectNameSplitted) < 6 {
+		return nil, errors.New(fmt.Sprintf("%s %s is not helm release %s", driver, m.Name, driver))
+	}
+	revision, err := strconv.Atoi(strings.Replace(objectNameSplitted[5], "v", "", -1))
+	if err != nil {
+		return nil, err
+	}
+	rev.ReleaseName = objectNameSplitted[4]
+	rev.Revision = revision
+
+	return rev, nil
+}
+
+// ReleaseID identifies the release across all of its revisions.
+func (r *HelmReleaseRevision) ReleaseID() string {
+	return fmt.Sprintf("%s-%s-%s-%s", r.Cluster, r.Driver, r.Namespace, r.ReleaseName)
+}
+
+// Key identifies the object which stores this revision.
+func (r *HelmReleaseRevision) Key() string {
+	return fmt.Sprintf("%s/%s/%s/%s", r.Cluster, r.Driver, r.Namespace, r.ObjectName)
+}
@@ -0,0 +1,61 @@
+package entities
+
+import (
+	"path"
+	"strings"
+)
+
+// NamespaceFilter decides which namespaces are scanned. Both lists may contain glob patterns.
+type NamespaceFilter struct {
+	Include []string
+	Exclude []string
+}
+
+func NewNamespaceFilter(include []string, exclude []string) *NamespaceFilter {
+	return &NamespaceFilter{
+		Include: include,
+		Exclude: exclude,
+	}
+}
+
+// Matches reports whether the namespace is included and not excluded.
+func (f *NamespaceFilter) Matches(namespace string) bool {
+	for _, pattern := range f.Exclude {
+		if matched, _ := path.Match(pattern, namespace); matched {
+			return false
+		}
+	}
+
+	if len(f.Include) == 0 {
+		return true
+	}
+
+	for _, pattern := range f.Include {
+		if matched, _ := path.Match(pattern, namespace); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ScopedNamespaces returns namespaces to be listed one by one, so that namespaced Roles are enough
+// to read releases. The [""] result means that all namespaces have to be listed at once, which
+// happens when no namespaces are included or some of them are glob patterns.
+func (f *NamespaceFilter) ScopedNamespaces() []string {
+	if len(f.Include) == 0 {
+		return []string{""}
+	}
+
+	var namespaces []string
+	for _, pattern := range f.Include {
+		if strings.ContainsAny(pattern, "*?[\\") {
+			return []string{""}
+		}
+		if f.Matches(pattern) {
+			namespaces = append(namespaces, pattern)
+		}
+	}
+
+	return namespaces
+}
@@ -0,0 +1,58 @@
+package entities
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNamespaceFilterMatches(t *testing.T) {
+	tests := []struct {
+		name      string
+		include   []string
+		exclude   []string
+		namespace string
+		matches   bool
+	}{
+		{name: "no filters", namespace: "default", matches: true},
+		{name: "included", include: []string{"apps", "default"}, namespace: "default", matches: true},
+		{name: "not included", include: []string{"apps"}, namespace: "default", matches: false},
+		{name: "included by pattern", include: []string{"team-*"}, namespace: "team-a", matches: true},
+		{name: "excluded", exclude: []string{"kube-system"}, namespace: "kube-system", matches: false},
+		{name: "excluded by pattern", exclude: []string{"kube-*"}, namespace: "kube-public", matches: false},
+		{name: "not excluded", exclude: []string{"kube-*"}, namespace: "default", matches: true},
+		{name: "exclude wins over include", include: []string{"team-*"}, exclude: []string{"team-b"}, namespace: "team-b", matches: false},
+		{name: "pattern doesn't match prefix only", include: []string{"team"}, namespace: "team-a", matches: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if matches := NewNamespaceFilter(tt.include, tt.exclude).Matches(tt.namespace); matches != tt.matches {
+				t.Errorf("Matches(%q) = %v, expected %v", tt.namespace, matches, tt.matches)
+			}
+		})
+	}
+}
+
+func TestNamespaceFilterScopedNamespaces(t *testing.T) {
+	tests := []struct {
+		name       string
+		include    []string
+		exclude    []string
+		namespaces []string
+	}{
+		{name: "no filters", namespaces: []string{""}},
+		{name: "exclude only", exclude: []string{"kube-system"}, namespaces: []string{""}},
+		{name: "included namespaces", include: []string{"apps", "default"}, namespaces: []string{"apps", "default"}},
+		{name: "included pattern", include: []string{"apps", "team-*"}, namespaces: []string{""}},
+		{name: "excluded namespace is skipped", include: []string{"apps", "default"}, exclude: []string{"default"}, namespaces: []string{"apps"}},
+		{name: "all namespaces excluded", include: []string{"default"}, exclude: []string{"*"}, namespaces: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if namespaces := NewNamespaceFilter(tt.include, tt.exclude).ScopedNamespaces(); !reflect.DeepEqual(namespaces, tt.namespaces) {
+				t.Errorf("ScopedNamespaces() = %q, expected %q", namespaces, tt.namespaces)
+			}
+		})
+	}
+}
@@ -0,0 +1,9 @@
+package entities
+
+// StoredChart is a packaged chart version kept in one of the chart stores.
+type StoredChart struct {
+	Name    string
+	Version string
+	// Digest is the sha256 digest of the package, it's empty when the store doesn't know it.
+	Digest string
+}
@@ -0,0 +1,136 @@
+package services
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/turboazot/helm-cache/pkg/utils"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"sigs.k8s.io/yaml"
+)
+
+// chartArchiveModTime is the modification time of all files of chart archives
+var chartArchiveModTime = time.Unix(0, 0).UTC()
+
+type chartArchiveEntry struct {
+	Name string
+	Data []byte
+}
+
+// saveChartArchive packages the chart like chartutil.Save, but reproducibly: files are sorted and have
+// fixed modification times, ownership and modes, and the gzip header has no timestamp. The same chart
+// contents always result in the same archive with the same digest. It returns the path of the archive.
+func saveChartArchive(ch *chart.Chart, outDir string) (string, error) {
+	if err := ch.Validate(); err != nil {
+		return "", err
+	}
+
+	entries, err := chartArchiveEntries(ch, "")
+	if err != nil {
+		return "", err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return "", err
+	}
+
+	// The archive is written to a temporary file first, so a partially written archive is never visible
+	filename := filepath.Join(outDir, fmt.Sprintf("%s-%s.tgz", ch.Name(), ch.Metadata.Version))
+	err = utils.WriteFileAtomically(filename, func(w io.Writer) error {
+		zipper := gzip.NewWriter(w)
+		zipper.Header.Comment = "Helm"
+		twriter := tar.NewWriter(zipper)
+
+		for _, entry := range entries {
+			err := twriter.WriteHeader(&tar.Header{
+				Name:     entry.Name,
+				Mode:     0644,
+				Size:     int64(len(entry.Data)),
+				ModTime:  chartArchiveModTime,
+				Typeflag: tar.TypeReg,
+				Format:   tar.FormatPAX,
+			})
+			if err != nil {
+				return err
+			}
+			if _, err := twriter.Write(entry.Data); err != nil {
+				return err
+			}
+		}
+
+		if err := twriter.Close(); err != nil {
+			return err
+		}
+		return zipper.Close()
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return filename, nil
+}
+
+// chartArchiveEntries collects files of the chart and its subcharts the same way chartutil.Save does.
+func chartArchiveEntries(ch *chart.Chart, prefix string) ([]chartArchiveEntry, error) {
+	base := path.Join(prefix, ch.Name())
+	var entries []chartArchiveEntry
+
+	// Dependencies of v1 charts are kept in requirements.yaml, which is one of files of the chart
+	metadata := *ch.Metadata
+	if metadata.APIVersion == chart.APIVersionV1 {
+		metadata.Dependencies = nil
+	}
+	data, err := yaml.Marshal(&metadata)
+	if err != nil {
+		return nil, err
+	}
+	entries = append(entries, chartArchiveEntry{Name: path.Join(base, chartutil.ChartfileName), Data: data})
+
+	if metadata.APIVersion == chart.APIVersionV2 && ch.Lock != nil {
+		data, err := yaml.Marshal(ch.Lock)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, chartArchiveEntry{Name: path.Join(base, "Chart.lock"), Data: data})
+	}
+
+	if values := findFile(ch.Raw, chartutil.ValuesfileName); values != nil {
+		entries = append(entries, chartArchiveEntry{Name: path.Join(base, chartutil.ValuesfileName), Data: values.Data})
+	}
+
+	if ch.Schema != nil {
+		if !json.Valid(ch.Schema) {
+			return nil, errors.New(fmt.Sprintf("Invalid JSON in %s of %s chart", chartutil.SchemafileName, ch.Name()))
+		}
+		entries = append(entries, chartArchiveEntry{Name: path.Join(base, chartutil.SchemafileName), Data: ch.Schema})
+	}
+
+	for _, files := range [][]*chart.File{ch.Templates, ch.Files} {
+		for _, f := range files {
+			entries = append(entries, chartArchiveEntry{Name: path.Join(base, f.Name), Data: f.Data})
+		}
+	}
+
+	for _, dependency := range ch.Dependencies() {
+		dependencyEntries, err := chartArchiveEntries(dependency, path.Join(base, chartutil.ChartsDir))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, dependencyEntries...)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,84 @@
+package services
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/turboazot/helm-cache/pkg/entities"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/provenance"
+	"helm.sh/helm/v3/pkg/release"
+)
+
+// packageTestChart saves the raw chart with the given modification time of its files and packages it.
+func packageTestChart(t *testing.T, ch *chart.Chart, modTime time.Time) (string, []byte) {
+	c := newTestHelmClient(t)
+
+	r := &entities.HelmRelease{Release: &release.Release{Name: "test", Namespace: "default", Chart: ch}}
+	if err := c.SaveRawChart(r); err != nil {
+		t.Fatal(err)
+	}
+
+	err := filepath.Walk(c.RawChartsDirectory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(path, modTime, modTime)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Package(ch.Name(), ch.Metadata.Version); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(c.PackagedChartsDirectory, "app-1.0.0.tgz")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path, data
+}
+
+func TestPackageIsReproducible(t *testing.T) {
+	disableNetwork(t)
+
+	newChart := func() *chart.Chart {
+		ch := newTestChart("app", "1.0.0", newTestChart("sub", "1.0.0"))
+		ch.Values["image"] = map[string]interface{}{"tag": "1.0.0", "repository": "app"}
+		ch.Files = []*chart.File{{Name: "README.md", Data: []byte("# App\n")}, {Name: "files/a.txt", Data: []byte("a")}}
+		return ch
+	}
+
+	firstPath, first := packageTestChart(t, newChart(), time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	secondPath, second := packageTestChart(t, newChart(), time.Date(2022, 6, 1, 12, 30, 0, 0, time.UTC))
+
+	if !bytes.Equal(first, second) {
+		t.Error("Packages of the same chart differ")
+	}
+
+	firstDigest, err := provenance.DigestFile(firstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondDigest, err := provenance.DigestFile(secondPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if firstDigest != secondDigest {
+		t.Errorf("Digests of the same chart differ: %s, %s", firstDigest, secondDigest)
+	}
+
+	info, err := os.Stat(firstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("Unexpected mode of the package: %v", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,203 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/turboazot/helm-cache/pkg/utils"
+	"helm.sh/helm/v3/pkg/chart"
+
+	"go.uber.org/zap"
+)
+
+// resolveDependencies copies packages of subcharts missing in the raw chart to its charts directory.
+// Helm v3 doesn't store subcharts in releases, so they're looked up offline in the packaged charts
+// of the local cache and in the Helm repository cache, and then in the configured chart stores.
+// Versions of Chart.lock are preferred to the version ranges of Chart.yaml. It returns the names
+// of subcharts which can't be found.
+func (c *HelmClient) resolveDependencies(directory string, ch *chart.Chart) ([]string, error) {
+	resolved := make(map[string]bool)
+	for _, dependency := range ch.Dependencies() {
+		resolved[dependency.Name()] = true
+	}
+
+	locked := make(map[string]string)
+	if ch.Lock != nil {
+		for _, dependency := range ch.Lock.Dependencies {
+			locked[dependency.Name] = dependency.Version
+		}
+	}
+
+	var missing []string
+	for _, dependency := range ch.Metadata.Dependencies {
+		if resolved[dependency.Name] {
+			continue
+		}
+
+		version := dependency.Version
+		if v, ok := locked[dependency.Name]; ok {
+			version = v
+		}
+
+		path, err := findDependencyPackage([]string{c.PackagedChartsDirectory, c.Settings.RepositoryCache}, dependency.Name, version)
+		if err != nil {
+			return nil, err
+		}
+		if path == "" {
+			path, err = c.fetchDependencyPackage(dependency.Name, version)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if path == "" {
+			missing = append(missing, fmt.Sprintf("%s (%s)", dependency.Name, version))
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Join(directory, "charts"), 0755); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(filepath.Join(directory, "charts", filepath.Base(path)), data, 0644); err != nil {
+			return nil, err
+		}
+		resolved[dependency.Name] = true
+
+		zap.L().Sugar().Infof("Dependency %s of %s-%s chart is taken from %s", dependency.Name, ch.Name(), ch.Metadata.Version, path)
+	}
+
+	return missing, nil
+}
+
+// fetchDependencyPackage downloads the highest version of the chart matching the version range from
+// the first chart store which has one to the packaged charts directory, so it's found there next time.
+// An empty path is returned if there are none.
+func (c *HelmClient) fetchDependencyPackage(chartName string, version string) (string, error) {
+	constraint, err := newDependencyConstraint(chartName, version)
+	if err != nil {
+		return "", err
+	}
+
+	for _, store := range c.ChartStores {
+		storedCharts, err := store.List()
+		if err != nil {
+			zap.L().Sugar().Infof("Can't list charts of %s to find %s dependency: %v", store.Name(), chartName, err)
+			continue
+		}
+
+		var best *semver.Version
+		for _, storedChart := range storedCharts {
+			if storedChart.Name != chartName {
+				continue
+			}
+			v, err := semver.NewVersion(storedChart.Version)
+			if err != nil || !isDependencyVersion(constraint, v) {
+				continue
+			}
+			if best == nil || v.GreaterThan(best) {
+				best = v
+			}
+		}
+		if best == nil {
+			continue
+		}
+
+		path, err := c.saveStoredPackage(store, chartName, best.Original())
+		if err != nil {
+			zap.L().Sugar().Infof("Can't get %s-%s dependency from %s: %v", chartName, best.Original(), store.Name(), err)
+			continue
+		}
+
+		return path, nil
+	}
+
+	return "", nil
+}
+
+func (c *HelmClient) saveStoredPackage(store ChartStore, chartName string, chartVersion string) (string, error) {
+	rc, err := store.Get(chartName, chartVersion)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	path := filepath.Join(c.PackagedChartsDirectory, fmt.Sprintf("%s-%s.tgz", chartName, chartVersion))
+	err = utils.WriteFileAtomically(path, func(w io.Writer) error {
+		_, err := io.Copy(w, rc)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// findDependencyPackage returns the path of the highest version of the chart package matching the
+// version range in the first directory which has one. An empty path is returned if there are none.
+func findDependencyPackage(directories []string, chartName string, version string) (string, error) {
+	constraint, err := newDependencyConstraint(chartName, version)
+	if err != nil {
+		return "", err
+	}
+
+	for _, directory := range directories {
+		if directory == "" {
+			continue
+		}
+
+		paths, err := filepath.Glob(filepath.Join(directory, fmt.Sprintf("%s-*.tgz", chartName)))
+		if err != nil {
+			return "", err
+		}
+
+		var best string
+		var bestVersion *semver.Version
+		for _, path := range paths {
+			// Names of other charts may start with the chart name, e.g. common and common-lib
+			v, err := semver.NewVersion(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), chartName+"-"), ".tgz"))
+			if err != nil {
+				continue
+			}
+			if !isDependencyVersion(constraint, v) {
+				continue
+			}
+			if bestVersion == nil || v.GreaterThan(bestVersion) {
+				best, bestVersion = path, v
+			}
+		}
+
+		if best != "" {
+			return best, nil
+		}
+	}
+
+	return "", nil
+}
+
+func newDependencyConstraint(chartName string, version string) (*semver.Constraints, error) {
+	constraint, err := semver.NewConstraint("*")
+	if version != "" {
+		constraint, err = semver.NewConstraint(version)
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid version %s of %s dependency: %v", version, chartName, err))
+	}
+
+	return constraint, nil
+}
+
+// isDependencyVersion reports whether the chart version matches the version range of the dependency.
+// Charts renamed because of conflicts aren't upstream versions, so they never match.
+func isDependencyVersion(constraint *semver.Constraints, v *semver.Version) bool {
+	return v.Metadata() == "" && constraint.Check(v)
+}
@@ -0,0 +1,40 @@
+package services
+
+import (
+	"io"
+
+	"github.com/turboazot/helm-cache/pkg/entities"
+)
+
+const (
+	// ConflictPolicySkip keeps the stored chart and reports the conflict
+	ConflictPolicySkip = "skip"
+	// ConflictPolicyOverwrite replaces the stored chart with the cached one
+	ConflictPolicyOverwrite = "overwrite"
+	// ConflictPolicyRename stores the cached chart under the version with a digest suffix
+	ConflictPolicyRename = "rename"
+)
+
+// ChartStore is a destination packaged charts are cached in.
+type ChartStore interface {
+	// Name returns a human readable name of the store used in logs.
+	Name() string
+	// Exists reports whether the chart version is stored.
+	Exists(chartName string, chartVersion string) (bool, error)
+	// Put stores the packaged chart read from r.
+	Put(chartName string, chartVersion string, r io.Reader) error
+	// Get returns the packaged chart, the caller has to close it.
+	Get(chartName string, chartVersion string) (io.ReadCloser, error)
+	// List returns all stored chart versions.
+	List() ([]entities.StoredChart, error)
+	// Delete removes the chart version from the store.
+	Delete(chartName string, chartVersion string) error
+}
+
+// DigestChartStore is a chart store which knows sha256 digests of stored packages, so packages
+// with the same name and version but different contents can be detected.
+type DigestChartStore interface {
+	ChartStore
+	// Digest returns the sha256 digest of the stored package.
+	Digest(chartName string, chartVersion string) (string, error)
+}
@@ -0,0 +1,164 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/turboazot/helm-cache/pkg/entities"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/engine"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	"sigs.k8s.io/yaml"
+)
+
+// ManifestMismatch is a resource rendered from a cached chart differently than it's deployed by the release.
+type ManifestMismatch struct {
+	Resource string
+	Diff     string
+}
+
+type manifestResourceHead struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Namespace string `json:"namespace"`
+		Name      string `json:"name"`
+	} `json:"metadata"`
+}
+
+// VerifyPackage renders the packaged chart of the release with the release values the same way
+// helm install and helm upgrade do, and compares every resource with the manifest of the release.
+// Rendering is done offline: lookup functions return nothing and default capabilities are used.
+func (c *HelmClient) VerifyPackage(r *entities.HelmRelease) ([]ManifestMismatch, error) {
+	ch, err := loader.Load(fmt.Sprintf("%s/%s-%s.tgz", c.PackagedChartsDirectory, r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := chartutil.ProcessDependencies(ch, r.Release.Config); err != nil {
+		return nil, err
+	}
+
+	values, err := chartutil.ToRenderValues(ch, r.Release.Config, chartutil.ReleaseOptions{
+		Name:      r.Release.Name,
+		Namespace: r.Release.Namespace,
+		Revision:  r.Release.Version,
+		IsInstall: r.Release.Version == 1,
+		IsUpgrade: r.Release.Version > 1,
+	}, chartutil.DefaultCapabilities)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := engine.Render(ch, values)
+	if err != nil {
+		return nil, err
+	}
+
+	// Notes and hooks aren't kept in the release manifest
+	for name := range files {
+		if strings.HasSuffix(name, "NOTES.txt") {
+			delete(files, name)
+		}
+	}
+	_, manifests, err := releaseutil.SortManifests(files, chartutil.DefaultCapabilities.APIVersions, releaseutil.InstallOrder)
+	if err != nil {
+		return nil, err
+	}
+
+	var rendered []string
+	for _, m := range manifests {
+		rendered = append(rendered, m.Content)
+	}
+
+	return diffManifests(r.Release.Manifest, strings.Join(rendered, "\n---\n"))
+}
+
+// diffManifests compares resources of the deployed and rendered manifests regardless of their order,
+// formatting and comments.
+func diffManifests(deployed string, rendered string) ([]ManifestMismatch, error) {
+	deployedResources, err := manifestResources(deployed)
+	if err != nil {
+		return nil, err
+	}
+	renderedResources, err := manifestResources(rendered)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]bool)
+	for key := range deployedResources {
+		keys[key] = true
+	}
+	for key := range renderedResources {
+		keys[key] = true
+	}
+
+	var mismatches []ManifestMismatch
+	for key := range keys {
+		if deployedResources[key] == renderedResources[key] {
+			continue
+		}
+
+		diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        difflib.SplitLines(deployedResources[key]),
+			B:        difflib.SplitLines(renderedResources[key]),
+			FromFile: "release",
+			ToFile:   "cached chart",
+			Context:  3,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		mismatches = append(mismatches, ManifestMismatch{Resource: key, Diff: diff})
+	}
+	sort.Slice(mismatches, func(i, j int) bool {
+		return mismatches[i].Resource < mismatches[j].Resource
+	})
+
+	return mismatches, nil
+}
+
+// manifestResources splits the manifest into resources keyed by their kind, namespace and name.
+// Resources are marshalled again, so they're compared with sorted keys and without comments.
+func manifestResources(manifest string) (map[string]string, error) {
+	resources := make(map[string]string)
+
+	for _, content := range releaseutil.SplitManifests(manifest) {
+		var resource map[string]interface{}
+		if err := yaml.Unmarshal([]byte(content), &resource); err != nil {
+			return nil, err
+		}
+		if len(resource) == 0 {
+			continue
+		}
+
+		var head manifestResourceHead
+		if err := yaml.Unmarshal([]byte(content), &head); err != nil {
+			return nil, err
+		}
+
+		data, err := yaml.Marshal(resource)
+		if err != nil {
+			return nil, err
+		}
+
+		key := fmt.Sprintf("%s %s %s/%s", head.APIVersion, head.Kind, head.Metadata.Namespace, head.Metadata.Name)
+		if head.Metadata.Namespace == "" {
+			key = fmt.Sprintf("%s %s %s", head.APIVersion, head.Kind, head.Metadata.Name)
+		}
+		// Resources rendered twice by mistake are still compared one by one
+		base := key
+		for i := 2; resources[key] != ""; i++ {
+			key = fmt.Sprintf("%s #%d", base, i)
+		}
+
+		resources[key] = string(data)
+	}
+
+	return resources, nil
+}
@@ -0,0 +1,138 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+const testDeployedManifest = `---
+# Source: app/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: test-app
+  namespace: default
+spec:
+  ports:
+    - port: 80
+---
+# Source: app/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: test-app
+data:
+  key: value
+`
+
+func TestDiffManifestsIgnoresOrderAndFormatting(t *testing.T) {
+	rendered := `apiVersion: v1
+kind: ConfigMap
+data: {key: "value"}
+metadata: {name: test-app}
+---
+spec:
+  ports:
+  - port: 80
+metadata:
+  namespace: default
+  name: test-app
+kind: Service
+apiVersion: v1
+`
+
+	mismatches, err := diffManifests(testDeployedManifest, rendered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 0 {
+		t.Fatalf("Expected no mismatches, got %v", mismatches)
+	}
+}
+
+func TestDiffManifestsReportsChangedResource(t *testing.T) {
+	rendered := strings.Replace(testDeployedManifest, "port: 80", "port: 8080", 1)
+
+	mismatches, err := diffManifests(testDeployedManifest, rendered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 1 || mismatches[0].Resource != "v1 Service default/test-app" {
+		t.Fatalf("Expected a mismatch of the service only, got %v", mismatches)
+	}
+	if !strings.Contains(mismatches[0].Diff, "-  - port: 80") || !strings.Contains(mismatches[0].Diff, "+  - port: 8080") {
+		t.Errorf("Diff doesn't show the changed port:\n%s", mismatches[0].Diff)
+	}
+}
+
+func TestDiffManifestsReportsMissingResources(t *testing.T) {
+	rendered := `apiVersion: v1
+kind: Service
+metadata:
+  name: test-app
+  namespace: default
+spec:
+  ports:
+    - port: 80
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: test-app
+`
+
+	mismatches, err := diffManifests(testDeployedManifest, rendered)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resources []string
+	for _, m := range mismatches {
+		resources = append(resources, m.Resource)
+	}
+	// The config map is only deployed and the secret is only rendered
+	if strings.Join(resources, ",") != "v1 ConfigMap test-app,v1 Secret test-app" {
+		t.Fatalf("Unexpected mismatches %v", resources)
+	}
+}
+
+func TestManifestResourcesKeepsDuplicates(t *testing.T) {
+	resources, err := manifestResources(testDeployedManifest + "---\n" + testDeployedManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 4 || resources["v1 Service default/test-app #2"] == "" {
+		t.Fatalf("Expected resources rendered twice to be kept, got %v", resources)
+	}
+}
+
+func TestVerifyPackage(t *testing.T) {
+	c := newTestHelmClient(t)
+	r := newTestRelease(t, newTestChart("app", "1.0.0"))
+	r.Release.Manifest = "---\n# Source: app/templates/service.yaml\napiVersion: v1\nkind: Service\nmetadata:\n  name: test-app\nspec:\n  ports:\n    - port: 80\n"
+
+	if err := c.SaveRawChart(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Package("app", "1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	mismatches, err := c.VerifyPackage(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 0 {
+		t.Fatalf("Expected the package to render the release manifest, got %v", mismatches)
+	}
+
+	// Values of the release are used for rendering
+	r.Release.Config = map[string]interface{}{"port": 8080}
+	mismatches, err = c.VerifyPackage(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 1 || mismatches[0].Resource != "v1 Service test-app" {
+		t.Fatalf("Expected a mismatch of the service, got %v", mismatches)
+	}
+}
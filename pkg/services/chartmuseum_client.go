@@ -2,6 +2,7 @@ package services
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,7 +10,7 @@ import (
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
-	"os"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/go-retryablehttp"
@@ -18,51 +19,124 @@ import (
 	"go.uber.org/zap"
 )
 
+// chartmuseumRetryInterval is an interval between attempts to load charts of an unavailable Chartmuseum
+const chartmuseumRetryInterval = 30 * time.Second
+
+// ChartmuseumAuth describes credentials of a Chartmuseum. Basic auth is used when both username and
+// password are set, a bearer token otherwise. Headers are added to every request, e.g. for auth proxies.
+type ChartmuseumAuth struct {
+	Username string
+	Password *SecretValue
+	Token    *SecretValue
+	Headers  map[string]string
+}
+
 type ChartmuseumClient struct {
-	ChartmuseumUrl      string
-	ChartmuseumUsername string
-	ChartmuseumPassword string
-	HttpClient          *retryablehttp.Client
-	ChartVersionCache   map[string]bool
+	ChartmuseumUrl    string
+	ChartmuseumAuth   ChartmuseumAuth
+	HttpClient        *retryablehttp.Client
+	ChartVersionCache map[string]bool
+	cacheMutex        sync.RWMutex
 }
 
-func NewChartmuseumClient(chartmuseumUrl string, chartmuseumUsername string, chartmuseumPassword string) (*ChartmuseumClient, error) {
+// NewChartmuseumClient creates a client and loads the list of existing charts in the background.
+// The list is reloaded every refreshInterval, so charts deleted from Chartmuseum are uploaded again.
+// Chartmuseum being unavailable at startup isn't fatal, loading is retried until it succeeds.
+func NewChartmuseumClient(chartmuseumUrl string, chartmuseumAuth ChartmuseumAuth, refreshInterval time.Duration, tlsConfig *tls.Config) (*ChartmuseumClient, error) {
 	retryClient := retryablehttp.NewClient()
 	retryClient.RetryMax = 5
 	retryClient.HTTPClient.Timeout = 5 * time.Second
+	if tlsConfig != nil {
+		transport, ok := retryClient.HTTPClient.Transport.(*http.Transport)
+		if !ok {
+			return nil, errors.New("Unexpected transport of chartmuseum HTTP client")
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
 
 	var c *ChartmuseumClient = &ChartmuseumClient{
-		ChartmuseumUrl:      chartmuseumUrl,
-		ChartmuseumUsername: chartmuseumUsername,
-		ChartmuseumPassword: chartmuseumPassword,
-		HttpClient:          retryClient,
-		ChartVersionCache:   make(map[string]bool),
+		ChartmuseumUrl:    chartmuseumUrl,
+		ChartmuseumAuth:   chartmuseumAuth,
+		HttpClient:        retryClient,
+		ChartVersionCache: make(map[string]bool),
 	}
 
 	if !c.IsActive() {
 		return c, nil
 	}
 
-	chartListBytes, err := c.GetAllCharts()
-	if err != nil {
-		return nil, err
+	if err := c.Refresh(); err != nil {
+		zap.L().Sugar().Infof("Can't load charts of %s chartmuseum, retrying in the background: %v", c.ChartmuseumUrl, err)
+		go c.refreshUntilSucceeded(chartmuseumRetryInterval)
 	}
 
-	var chartsMap map[string][]entities.RestChart
+	if refreshInterval > 0 {
+		go c.refreshPeriodically(refreshInterval)
+	}
+
+	return c, nil
+}
 
-	err = json.Unmarshal(chartListBytes, &chartsMap)
+// Refresh reloads the list of existing charts.
+func (c *ChartmuseumClient) Refresh() error {
+	charts, err := c.List()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	for chartName, chartsArray := range chartsMap {
-		for _, chart := range chartsArray {
-			chartInstanceVersion := chart.Version
-			c.ChartVersionCache[fmt.Sprintf("%s-%s", chartName, chartInstanceVersion)] = true
+	chartVersionCache := make(map[string]bool)
+	for _, chart := range charts {
+		chartVersionCache[fmt.Sprintf("%s-%s", chart.Name, chart.Version)] = true
+	}
+
+	c.cacheMutex.Lock()
+	c.ChartVersionCache = chartVersionCache
+	c.cacheMutex.Unlock()
+
+	return nil
+}
+
+func (c *ChartmuseumClient) refreshUntilSucceeded(retryInterval time.Duration) {
+	for {
+		time.Sleep(retryInterval)
+
+		if err := c.Refresh(); err != nil {
+			zap.L().Sugar().Infof("Can't load charts of %s chartmuseum: %v", c.ChartmuseumUrl, err)
+			continue
 		}
+
+		zap.L().Sugar().Infof("Successfully loaded charts of %s chartmuseum", c.ChartmuseumUrl)
+		return
 	}
+}
 
-	return c, nil
+func (c *ChartmuseumClient) refreshPeriodically(refreshInterval time.Duration) {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := c.Refresh(); err != nil {
+			zap.L().Sugar().Infof("Can't refresh charts of %s chartmuseum: %v", c.ChartmuseumUrl, err)
+		}
+	}
+}
+
+func (c *ChartmuseumClient) setCached(chartName string, chartVersion string, exists bool) {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+
+	if exists {
+		c.ChartVersionCache[fmt.Sprintf("%s-%s", chartName, chartVersion)] = true
+	} else {
+		delete(c.ChartVersionCache, fmt.Sprintf("%s-%s", chartName, chartVersion))
+	}
+}
+
+func (c *ChartmuseumClient) isCached(chartName string, chartVersion string) bool {
+	c.cacheMutex.RLock()
+	defer c.cacheMutex.RUnlock()
+
+	return c.ChartVersionCache[fmt.Sprintf("%s-%s", chartName, chartVersion)]
 }
 
 func (c *ChartmuseumClient) IsActive() bool {
@@ -70,17 +144,45 @@ func (c *ChartmuseumClient) IsActive() bool {
 }
 
 func (c *ChartmuseumClient) hasBasicAuth() bool {
-	return c.ChartmuseumUsername != "" && c.ChartmuseumPassword != ""
+	return c.ChartmuseumAuth.Username != "" && c.ChartmuseumAuth.Password.IsSet()
 }
 
-func (c *ChartmuseumClient) GetAllCharts() ([]byte, error) {
-	req, err := retryablehttp.NewRequest("GET", fmt.Sprintf("%s/api/charts", c.ChartmuseumUrl), nil)
+func (c *ChartmuseumClient) Name() string {
+	return fmt.Sprintf("chartmuseum %s", c.ChartmuseumUrl)
+}
+
+func (c *ChartmuseumClient) newRequest(method string, path string, body interface{}) (*retryablehttp.Request, error) {
+	req, err := retryablehttp.NewRequest(method, fmt.Sprintf("%s%s", c.ChartmuseumUrl, path), body)
 	if err != nil {
 		return nil, err
 	}
 
+	for name, value := range c.ChartmuseumAuth.Headers {
+		req.Header.Set(name, value)
+	}
+
+	// Credentials are read on every request, so rotated ones are used as soon as they change
 	if c.hasBasicAuth() {
-		req.SetBasicAuth(c.ChartmuseumUsername, c.ChartmuseumPassword)
+		password, err := c.ChartmuseumAuth.Password.Get()
+		if err != nil {
+			return nil, err
+		}
+		req.SetBasicAuth(c.ChartmuseumAuth.Username, password)
+	} else if c.ChartmuseumAuth.Token.IsSet() {
+		token, err := c.ChartmuseumAuth.Token.Get()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+
+	return req, nil
+}
+
+func (c *ChartmuseumClient) GetAllCharts() ([]byte, error) {
+	req, err := c.newRequest("GET", "/api/charts", nil)
+	if err != nil {
+		return nil, err
 	}
 
 	resp, err := c.HttpClient.Do(req)
@@ -102,23 +204,15 @@ func (c *ChartmuseumClient) GetAllCharts() ([]byte, error) {
 	return respBody, nil
 }
 
-func (c *ChartmuseumClient) Upload(chartName string, chartVersion string, f *os.File) error {
-	fileContents, err := ioutil.ReadAll(f)
-	if err != nil {
-		return err
-	}
-	fi, err := f.Stat()
-	if err != nil {
-		return err
-	}
-	f.Close()
+func (c *ChartmuseumClient) Put(chartName string, chartVersion string, r io.Reader) error {
+	fileContents, err := ioutil.ReadAll(r)
 	if err != nil {
 		return err
 	}
 
 	body := new(bytes.Buffer)
 	writer := multipart.NewWriter(body)
-	part, err := writer.CreateFormFile("chart", fi.Name())
+	part, err := writer.CreateFormFile("chart", fmt.Sprintf("%s-%s.tgz", chartName, chartVersion))
 	if err != nil {
 		return err
 	}
@@ -130,14 +224,10 @@ func (c *ChartmuseumClient) Upload(chartName string, chartVersion string, f *os.
 	if err != nil {
 		return err
 	}
-	req, err := retryablehttp.NewRequest("POST", fmt.Sprintf("%s/api/charts", c.ChartmuseumUrl), body)
+	req, err := c.newRequest("POST", "/api/charts", body)
 	if err != nil {
 		return err
 	}
-
-	if c.hasBasicAuth() {
-		req.SetBasicAuth(c.ChartmuseumUsername, c.ChartmuseumPassword)
-	}
 	req.Header.Add("Content-Type", writer.FormDataContentType())
 
 	resp, err := c.HttpClient.Do(req)
@@ -151,16 +241,140 @@ func (c *ChartmuseumClient) Upload(chartName string, chartVersion string, f *os.
 	}
 
 	if resp.StatusCode != http.StatusCreated {
-		return errors.New(fmt.Sprintf("Receiving list of charts failed. Status code - %d, Body - %s", resp.StatusCode, string(responseBody)))
+		return errors.New(fmt.Sprintf("Uploading chart failed. Status code - %d, Body - %s", resp.StatusCode, string(responseBody)))
 	}
 
-	c.ChartVersionCache[fmt.Sprintf("%s-%s", chartName, chartVersion)] = true
+	c.setCached(chartName, chartVersion, true)
 
 	zap.L().Sugar().Infof("Successfully uploaded chart: %s-%s", chartName, chartVersion)
 
 	return resp.Body.Close()
 }
 
-func (c *ChartmuseumClient) IsExists(chartName string, chartVersion string) bool {
-	return c.ChartVersionCache[fmt.Sprintf("%s-%s", chartName, chartVersion)]
+// Exists looks the chart version up in the list of existing charts. If it's missing there,
+// Chartmuseum is asked about it, as the list may be outdated or not loaded yet.
+func (c *ChartmuseumClient) Exists(chartName string, chartVersion string) (bool, error) {
+	if c.isCached(chartName, chartVersion) {
+		return true, nil
+	}
+
+	req, err := c.newRequest("HEAD", fmt.Sprintf("/api/charts/%s/%s", chartName, chartVersion), nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := c.HttpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		c.setCached(chartName, chartVersion, true)
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, errors.New(fmt.Sprintf("Checking chart failed. Status code - %d", resp.StatusCode))
+	}
+}
+
+// Digest returns the digest of the chart version Chartmuseum has computed on upload.
+func (c *ChartmuseumClient) Digest(chartName string, chartVersion string) (string, error) {
+	req, err := c.newRequest("GET", fmt.Sprintf("/api/charts/%s/%s", chartName, chartVersion), nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.HttpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(fmt.Sprintf("Receiving chart failed. Status code - %d, Body - %s", resp.StatusCode, string(responseBody)))
+	}
+
+	var chart entities.RestChart
+	if err := json.Unmarshal(responseBody, &chart); err != nil {
+		return "", err
+	}
+
+	return chart.Digest, nil
+}
+
+func (c *ChartmuseumClient) Get(chartName string, chartVersion string) (io.ReadCloser, error) {
+	req, err := c.newRequest("GET", fmt.Sprintf("/charts/%s-%s.tgz", chartName, chartVersion), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.HttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		responseBody, _ := io.ReadAll(resp.Body)
+		return nil, errors.New(fmt.Sprintf("Downloading chart failed. Status code - %d, Body - %s", resp.StatusCode, string(responseBody)))
+	}
+
+	return resp.Body, nil
+}
+
+func (c *ChartmuseumClient) List() ([]entities.StoredChart, error) {
+	chartListBytes, err := c.GetAllCharts()
+	if err != nil {
+		return nil, err
+	}
+
+	var chartsMap map[string][]entities.RestChart
+	if err := json.Unmarshal(chartListBytes, &chartsMap); err != nil {
+		return nil, err
+	}
+
+	var charts []entities.StoredChart
+	for chartName, chartsArray := range chartsMap {
+		for _, chart := range chartsArray {
+			charts = append(charts, entities.StoredChart{
+				Name:    chartName,
+				Version: chart.Version,
+				Digest:  chart.Digest,
+			})
+		}
+	}
+
+	return charts, nil
+}
+
+func (c *ChartmuseumClient) Delete(chartName string, chartVersion string) error {
+	req, err := c.newRequest("DELETE", fmt.Sprintf("/api/charts/%s/%s", chartName, chartVersion), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		responseBody, _ := io.ReadAll(resp.Body)
+		return errors.New(fmt.Sprintf("Deleting chart failed. Status code - %d, Body - %s", resp.StatusCode, string(responseBody)))
+	}
+
+	c.setCached(chartName, chartVersion, false)
+
+	zap.L().Sugar().Infof("Successfully deleted chart: %s-%s", chartName, chartVersion)
+
+	return nil
 }
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/turboazot/helm-cache/pkg/utils"
+)
+
+func newTestChartmuseum(t *testing.T) *httptest.Server {
+	charts := map[string]bool{"/api/charts/app/1.0.0": true}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/charts":
+			if charts["/api/charts/app/1.0.0"] {
+				w.Write([]byte(`{"app":[{"name":"app","version":"1.0.0"}]}`))
+			} else {
+				w.Write([]byte(`{}`))
+			}
+		case r.Method == http.MethodHead && charts[r.URL.Path]:
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodDelete && charts[r.URL.Path]:
+			delete(charts, r.URL.Path)
+			w.Write([]byte(`{"deleted":true}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestChartmuseumClientDelete(t *testing.T) {
+	server := newTestChartmuseum(t)
+
+	c, err := NewChartmuseumClient(server.URL, ChartmuseumAuth{}, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.isCached("app", "1.0.0") {
+		t.Fatal("app-1.0.0 isn't loaded from chartmuseum")
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- c.Delete("app", "1.0.0")
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Delete is blocked")
+	}
+
+	if c.isCached("app", "1.0.0") {
+		t.Error("app-1.0.0 is still cached after it's deleted")
+	}
+
+	exists, err := c.Exists("app", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Error("app-1.0.0 exists after it's deleted")
+	}
+}
+
+func TestChartmuseumClientTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"app":[{"name":"app","version":"1.0.0"}]}`))
+	}))
+	t.Cleanup(server.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := utils.NewTLSConfig(caFile, "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewChartmuseumClient(server.URL, ChartmuseumAuth{}, 0, tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if !c.isCached("app", "1.0.0") {
+		t.Error("app-1.0.0 isn't loaded from chartmuseum")
+	}
+
+	untrusted := &ChartmuseumClient{ChartmuseumUrl: server.URL, HttpClient: retryablehttp.NewClient(), ChartVersionCache: make(map[string]bool)}
+	untrusted.HttpClient.RetryMax = 0
+	if err := untrusted.Refresh(); err == nil {
+		t.Error("Certificate of an unknown CA is trusted")
+	}
+}
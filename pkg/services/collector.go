@@ -1,105 +1,683 @@
 package services
 
 import (
-	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/turboazot/helm-cache/pkg/entities"
 	"go.uber.org/zap"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"helm.sh/helm/v3/pkg/release"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
 type Collector struct {
-	HelmClient          *HelmClient
-	ChartmuseumClient   *ChartmuseumClient
-	KubernetesClientset *kubernetes.Clientset
+	HelmClient      *HelmClient
+	ChartStores     []ChartStore
+	ConflictPolicy  string
+	VerifyCharts    bool
+	ReleaseSources  []ReleaseSource
+	AllRevisions    bool
+	ReleaseStatuses []string
+	GitOpsClients   map[string]*GitOpsClient
+	// ChartSourcesInterval is an interval between reloading chart sources while scanning releases
+	ChartSourcesInterval time.Duration
+	CheckedRevisions     map[string]string
+	// revisionCharts keeps charts of checked revisions, so revisions are checked again when
+	// their chart disappears from one of chart stores
+	revisionCharts map[string]entities.StoredChart
+	ChartSources   map[string]map[string]*entities.ChartSource
+	// chartSourcesTime is the time chart sources have been loaded at
+	chartSourcesTime time.Time
+	notInstalled     map[string]bool
+	// conflicts are conflicting stored packages already counted in metrics
+	conflicts map[string]bool
+	mutex     sync.Mutex
 }
 
-func NewCollector(helmClient *HelmClient, chartmuseumClient *ChartmuseumClient, kubeconfigPath string) (*Collector, error) {
-	var config *rest.Config
-	var err error
+func NewCollector(helmClient *HelmClient, chartStores []ChartStore, conflictPolicy string, verifyCharts bool, releaseSources []ReleaseSource, allRevisions bool, releaseStatuses []string, gitOpsClients map[string]*GitOpsClient, chartSourcesInterval time.Duration) (*Collector, error) {
+	if len(releaseSources) == 0 {
+		return nil, errors.New("At least one release source is required")
+	}
 
-	if kubeconfigPath == "" {
-		zap.L().Sugar().Info("Using in-cluster kubeconfig")
-		config, err = rest.InClusterConfig()
-		if err != nil {
-			return nil, err
+	switch conflictPolicy {
+	case "", ConflictPolicySkip, ConflictPolicyOverwrite, ConflictPolicyRename:
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported conflict policy: %s", conflictPolicy))
+	}
+
+	for _, status := range releaseStatuses {
+		if !isReleaseStatus(status) {
+			return nil, errors.New(fmt.Sprintf("Unsupported release status: %s", status))
 		}
-	} else {
-		zap.L().Sugar().Infof("Using %s kubeconfig", kubeconfigPath)
-		config, err = clientcmd.BuildConfigFromFlags("", kubeconfigPath)
-		if err != nil {
-			return nil, err
+	}
+
+	return &Collector{
+		HelmClient:           helmClient,
+		ChartStores:          chartStores,
+		ConflictPolicy:       conflictPolicy,
+		VerifyCharts:         verifyCharts,
+		ReleaseSources:       releaseSources,
+		AllRevisions:         allRevisions,
+		ReleaseStatuses:      releaseStatuses,
+		GitOpsClients:        gitOpsClients,
+		ChartSourcesInterval: chartSourcesInterval,
+		CheckedRevisions:     make(map[string]string),
+		revisionCharts:       make(map[string]entities.StoredChart),
+		ChartSources:         make(map[string]map[string]*entities.ChartSource),
+		notInstalled:         make(map[string]bool),
+		conflicts:            make(map[string]bool),
+	}, nil
+}
+
+// NewReleaseSources creates release sources for the given Helm storage drivers. Kubernetes based
+// sources are created for every cluster and share a single connection to it. A cluster which can't
+// be connected to is skipped, so it doesn't prevent scanning of the other clusters.
+func NewReleaseSources(helmClient *HelmClient, clusters []entities.ClusterConfig, drivers []string, sqlConnectionString string, namespaceFilter *entities.NamespaceFilter) ([]ReleaseSource, error) {
+	var releaseSources []ReleaseSource
+
+	for _, driver := range drivers {
+		switch driver {
+		case SecretDriver, ConfigMapDriver, TillerDriver:
+		case SQLDriver:
+			sqlReleaseSource, err := NewSQLReleaseSource(helmClient, sqlConnectionString, namespaceFilter)
+			if err != nil {
+				return nil, err
+			}
+			releaseSources = append(releaseSources, sqlReleaseSource)
+		default:
+			return nil, errors.New(fmt.Sprintf("Unsupported helm storage driver: %s", driver))
+		}
+	}
+
+	for _, cluster := range clusters {
+		var clientset *kubernetes.Clientset
+		var metadataClient metadata.Interface
+
+		for _, driver := range drivers {
+			if driver == SQLDriver {
+				continue
+			}
+
+			if clientset == nil {
+				config, err := newKubernetesConfig(cluster)
+				if err != nil {
+					zap.L().Sugar().Infof("Can't load kubeconfig of %s cluster: %v", cluster.Name, err)
+					break
+				}
+
+				clientset, err = kubernetes.NewForConfig(config)
+				if err != nil {
+					zap.L().Sugar().Infof("Can't create kubernetes client for %s cluster: %v", cluster.Name, err)
+					break
+				}
+
+				metadataClient, err = metadata.NewForConfig(config)
+				if err != nil {
+					zap.L().Sugar().Infof("Can't create kubernetes metadata client for %s cluster: %v", cluster.Name, err)
+					break
+				}
+			}
+
+			switch driver {
+			case SecretDriver:
+				releaseSources = append(releaseSources, NewSecretReleaseSource(cluster.Name, helmClient, clientset, metadataClient, namespaceFilter))
+			case ConfigMapDriver:
+				releaseSources = append(releaseSources, NewConfigMapReleaseSource(cluster.Name, helmClient, clientset, metadataClient, namespaceFilter))
+			case TillerDriver:
+				releaseSources = append(releaseSources, NewTillerReleaseSource(cluster.Name, helmClient, clientset, metadataClient, namespaceFilter))
+			}
 		}
 	}
 
-	clientset, err := kubernetes.NewForConfig(config)
+	return releaseSources, nil
+}
+
+// NewKubernetesClientset creates a client of the cluster, e.g. to read secrets with credentials.
+func NewKubernetesClientset(cluster entities.ClusterConfig) (*kubernetes.Clientset, error) {
+	config, err := newKubernetesConfig(cluster)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Collector{
-		HelmClient:          helmClient,
-		ChartmuseumClient:   chartmuseumClient,
-		KubernetesClientset: clientset,
-	}, nil
+	return kubernetes.NewForConfig(config)
 }
 
-func (c *Collector) CheckAllSecrets() error {
-	secrets, err := c.KubernetesClientset.CoreV1().Secrets("").List(context.TODO(), metav1.ListOptions{})
-	if err != nil {
-		return err
+func newKubernetesConfig(cluster entities.ClusterConfig) (*rest.Config, error) {
+	if cluster.InCluster {
+		zap.L().Sugar().Infof("Using in-cluster kubeconfig for %s cluster", cluster.Name)
+		return rest.InClusterConfig()
 	}
 
-	rsMap, err := c.HelmClient.GetLastRevisionReleaseSecretsMap(secrets)
-	if err != nil {
+	zap.L().Sugar().Infof("Using %s kubeconfig for %s cluster", cluster.KubeconfigPath, cluster.Name)
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: cluster.KubeconfigPath},
+		&clientcmd.ConfigOverrides{CurrentContext: cluster.Context},
+	).ClientConfig()
+}
+
+// CheckAllReleases lists revisions of all releases and fetches the payload only for
+// last revisions (or all retained revisions with AllRevisions) which haven't been checked yet.
+// A failing source doesn't stop checking of the other ones, an error is returned only when
+// all sources have failed.
+func (c *Collector) CheckAllReleases() error {
+	var err error
+	var allRevisions []*entities.HelmReleaseRevision
+	failedSources := 0
+	failedClusters := make(map[string]bool)
+
+	// Listing GitOps resources of all namespaces is expensive, so it isn't done on every scan
+	if time.Since(c.chartSourcesTime) >= c.ChartSourcesInterval {
+		c.refreshChartSources()
+	}
+
+	for _, source := range c.ReleaseSources {
+		revisions, listErr := source.ListRevisions()
+		if listErr != nil {
+			zap.L().Sugar().Infof("Can't list %s release revisions of %s cluster: %v", source.Driver(), source.Cluster(), listErr)
+			err = listErr
+			failedSources++
+			failedClusters[source.Cluster()] = true
+			continue
+		}
+
+		c.checkReleaseRevisions(source, revisions)
+		allRevisions = append(allRevisions, revisions...)
+	}
+
+	if failedSources == len(c.ReleaseSources) {
 		return err
 	}
 
-	for _, rs := range rsMap {
-		zap.L().Sugar().Infof("Checking secret %s...", rs.Secret.Name)
+	c.reportNotInstalledCharts(allRevisions, failedClusters)
+
+	return nil
+}
+
+// CheckChartSources refreshes chart sources declared by GitOps resources and reports charts
+// which haven't been installed yet.
+func (c *Collector) CheckChartSources() {
+	if len(c.GitOpsClients) == 0 {
+		return
+	}
+
+	c.refreshChartSources()
 
-		r, err := c.HelmClient.GetHelmRelease(rs)
+	var allRevisions []*entities.HelmReleaseRevision
+	failedClusters := make(map[string]bool)
+	for _, source := range c.ReleaseSources {
+		revisions, err := source.ListRevisions()
 		if err != nil {
-			zap.L().Sugar().Infof("Can't decode release from secret %s: %v", rs.Secret.Name, err)
+			zap.L().Sugar().Infof("Can't list %s release revisions of %s cluster: %v", source.Driver(), source.Cluster(), err)
+			failedClusters[source.Cluster()] = true
 			continue
 		}
+		allRevisions = append(allRevisions, revisions...)
+	}
+
+	c.reportNotInstalledCharts(allRevisions, failedClusters)
+}
+
+func (c *Collector) refreshChartSources() {
+	c.chartSourcesTime = time.Now()
 
-		if c.ChartmuseumClient.IsActive() && c.ChartmuseumClient.IsExists(r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version) {
-			zap.L().Sugar().Infof("Chart %s-%s already exists in the chartmuseum", r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version)
+	for clusterName, gitOpsClient := range c.GitOpsClients {
+		sources, err := gitOpsClient.GetChartSources()
+		if err != nil {
+			zap.L().Sugar().Infof("Can't get chart sources of %s cluster: %v", clusterName, err)
 			continue
 		}
 
-		if err := c.HelmClient.SaveRawChart(r); err != nil {
-			zap.L().Sugar().Infof("Can't save %s-%s chart in local filesystem: %v", r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version, err)
+		c.mutex.Lock()
+		c.ChartSources[clusterName] = sources
+		c.mutex.Unlock()
+	}
+}
+
+// reportNotInstalledCharts reports chart sources without stored revisions of their releases.
+// Clusters whose revisions failed to be listed are skipped, so their releases aren't reported as missing.
+func (c *Collector) reportNotInstalledCharts(revisions []*entities.HelmReleaseRevision, failedClusters map[string]bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	installedReleases := make(map[string]bool)
+	for _, rev := range revisions {
+		installedReleases[fmt.Sprintf("%s/%s/%s", rev.Cluster, rev.Namespace, rev.ReleaseName)] = true
+	}
+
+	for clusterName, sources := range c.ChartSources {
+		if failedClusters[clusterName] {
 			continue
 		}
+		for _, source := range sources {
+			// Argo CD renders charts with helm template and never creates helm releases
+			if source.Tool == ArgoCDTool {
+				continue
+			}
 
-		if r.IsPackaged {
-			zap.L().Sugar().Infof("Chart %s-%s is already packaged in local filesystem", r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version)
-		} else {
-			if err := c.HelmClient.Package(r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version); err != nil {
-				zap.L().Sugar().Infof("Can't package %s-%s chart in local filesystem: %v", r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version, err)
+			releaseKey := fmt.Sprintf("%s/%s", clusterName, source.StorageKey())
+			if installedReleases[releaseKey] {
+				delete(c.notInstalled, releaseKey)
 				continue
 			}
-			r.IsPackaged = true
+			if c.notInstalled[releaseKey] {
+				continue
+			}
+			c.notInstalled[releaseKey] = true
+
+			zap.L().Sugar().Infof("Chart %s %s from %s is declared by %s %s/%s in %s cluster, but hasn't been installed as a helm release yet", source.Chart, source.Version, source.RepoURL, source.Kind, source.Namespace, source.Name, clusterName)
+		}
+	}
+}
+
+// Watch watches all release sources and checks the latest revision of a release whenever one
+// of its revisions is added or updated. Every resyncInterval all releases are replayed, so
+// revisions that failed to be cached earlier are retried. Sources which can't be watched are
+// scanned every scanningInterval instead. It blocks until stopCh is closed.
+func (c *Collector) Watch(scanningInterval time.Duration, resyncInterval time.Duration, stopCh <-chan struct{}) {
+	var wg sync.WaitGroup
+
+	if len(c.GitOpsClients) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(resyncInterval)
+			defer ticker.Stop()
+
+			for {
+				c.CheckChartSources()
+
+				select {
+				case <-stopCh:
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+
+	for _, source := range c.ReleaseSources {
+		wg.Add(1)
+
+		watchableSource, ok := source.(WatchableReleaseSource)
+		if !ok {
+			go func(source ReleaseSource) {
+				defer wg.Done()
+				c.pollReleaseSource(source, scanningInterval, stopCh)
+			}(source)
+			continue
 		}
 
-		if c.ChartmuseumClient.IsActive() {
-			packageFile, err := c.HelmClient.GetReleasePackageFile(r)
+		go func() {
+			defer wg.Done()
+			err := watchableSource.Watch(resyncInterval, func(revisions []*entities.HelmReleaseRevision) {
+				c.checkReleaseRevisions(watchableSource, revisions)
+			}, stopCh)
 			if err != nil {
-				zap.L().Sugar().Infof("Can't get package file for %s-%s chart in local filesystem: %v", r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version, err)
+				zap.L().Sugar().Infof("Can't watch %s releases of %s cluster: %v", watchableSource.Driver(), watchableSource.Cluster(), err)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func (c *Collector) pollReleaseSource(source ReleaseSource, scanningInterval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(scanningInterval)
+	defer ticker.Stop()
+
+	for {
+		revisions, err := source.ListRevisions()
+		if err != nil {
+			zap.L().Sugar().Infof("Can't list %s release revisions of %s cluster: %v", source.Driver(), source.Cluster(), err)
+		} else {
+			c.checkReleaseRevisions(source, revisions)
+		}
+
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Collector) checkReleaseRevisions(source ReleaseSource, revisions []*entities.HelmReleaseRevision) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Revisions are filtered by status first, so a deployed revision is still cached after a failed upgrade
+	allowedRevisions := make([]*entities.HelmReleaseRevision, 0, len(revisions))
+	for _, rev := range revisions {
+		if rev.Status == "" || c.isAllowedStatus(rev.Status) {
+			allowedRevisions = append(allowedRevisions, rev)
+		}
+	}
+	revisions = allowedRevisions
+
+	if !c.AllRevisions {
+		lastRevisionsMap := c.HelmClient.GetLastRevisionsMap(revisions)
+		revisions = make([]*entities.HelmReleaseRevision, 0, len(lastRevisionsMap))
+		for _, rev := range lastRevisionsMap {
+			revisions = append(revisions, rev)
+		}
+	}
+
+	for _, rev := range revisions {
+		if status, checked := c.CheckedRevisions[rev.Key()]; checked && status == rev.Status && c.isStillUploaded(rev) {
+			continue
+		}
+
+		c.CheckReleaseRevision(source, rev)
+	}
+}
+
+// isReleaseStatus reports whether the status is one of statuses of Helm releases.
+func isReleaseStatus(status string) bool {
+	for _, s := range []release.Status{
+		release.StatusUnknown,
+		release.StatusDeployed,
+		release.StatusUninstalled,
+		release.StatusSuperseded,
+		release.StatusFailed,
+		release.StatusUninstalling,
+		release.StatusPendingInstall,
+		release.StatusPendingUpgrade,
+		release.StatusPendingRollback,
+	} {
+		if s.String() == status {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isAllowedStatus reports whether charts of releases with the status should be cached.
+// All statuses are allowed when no release statuses are configured.
+func (c *Collector) isAllowedStatus(status string) bool {
+	if len(c.ReleaseStatuses) == 0 {
+		return true
+	}
+
+	for _, s := range c.ReleaseStatuses {
+		if s == status {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isUploaded reports whether the chart exists in all configured chart stores.
+// It's false when no chart store is configured, so charts are still cached locally.
+func (c *Collector) isUploaded(chartName string, chartVersion string) bool {
+	if len(c.ChartStores) == 0 {
+		return false
+	}
+
+	for _, store := range c.ChartStores {
+		if !c.isUploadedToStore(store, chartName, chartVersion) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *Collector) isUploadedToStore(store ChartStore, chartName string, chartVersion string) bool {
+	exists, err := store.Exists(chartName, chartVersion)
+	if err != nil {
+		zap.L().Sugar().Infof("Can't check whether %s-%s chart exists in %s: %v", chartName, chartVersion, store.Name(), err)
+		return false
+	}
+
+	return exists
+}
+
+// isStillUploaded reports whether the chart of the checked revision still exists in all chart stores.
+func (c *Collector) isStillUploaded(rev *entities.HelmReleaseRevision) bool {
+	chart, ok := c.revisionCharts[rev.Key()]
+	if !ok || len(c.ChartStores) == 0 {
+		return true
+	}
+
+	if c.isUploaded(chart.Name, chart.Version) {
+		return true
+	}
+
+	zap.L().Sugar().Infof("Chart %s-%s of %s %s/%s has disappeared from one of chart stores", chart.Name, chart.Version, rev.Driver, rev.Namespace, rev.ObjectName)
+	return false
+}
+
+// uploadToStores uploads the packaged chart to every chart store it's missing in. A failing store
+// doesn't prevent uploads to the other ones, so only failed stores are retried on the next check.
+// With a conflict policy charts which already exist are compared with the packaged chart.
+// The status of every attempted upload is recorded in metadata of the chart.
+func (c *Collector) uploadToStores(r *entities.HelmRelease) bool {
+	chartName := r.Release.Chart.Metadata.Name
+	chartVersion := r.Release.Chart.Metadata.Version
+	uploaded := true
+
+	for _, store := range c.ChartStores {
+		destination := entities.CachedChartDestination{Name: store.Name(), Uploaded: true}
+
+		var err error
+		if c.isUploadedToStore(store, chartName, chartVersion) {
+			if c.ConflictPolicy == "" {
 				continue
 			}
 
-			err = c.ChartmuseumClient.Upload(r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version, packageFile)
-			if err != nil {
-				zap.L().Sugar().Infof("Can't upload %s-%s chart: %v", r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version, err)
+			destination.Conflict, err = c.hasConflict(store, chartName, chartVersion)
+			if err == nil && !destination.Conflict {
 				continue
 			}
+			if err == nil {
+				err = c.resolveConflict(r, store)
+			}
+		} else {
+			err = c.uploadToStore(r, store)
+		}
+
+		if err != nil {
+			zap.L().Sugar().Infof("Can't upload %s-%s chart to %s: %v", chartName, chartVersion, store.Name(), err)
+			destination.Uploaded = false
+			destination.Error = err.Error()
+			uploaded = false
+		}
+
+		if err := c.HelmClient.RecordDestination(chartName, chartVersion, destination); err != nil {
+			zap.L().Sugar().Infof("Can't record upload status of %s-%s chart: %v", chartName, chartVersion, err)
 		}
 	}
 
-	return nil
+	return uploaded
+}
+
+func (c *Collector) uploadToStore(r *entities.HelmRelease, store ChartStore) error {
+	packageFile, err := c.HelmClient.GetReleasePackageFile(r)
+	if err != nil {
+		return err
+	}
+	defer packageFile.Close()
+
+	return store.Put(r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version, packageFile)
+}
+
+// hasConflict reports whether the chart store keeps a package with a digest different from the
+// packaged chart. Stores which don't know digests never conflict.
+func (c *Collector) hasConflict(store ChartStore, chartName string, chartVersion string) (bool, error) {
+	digestStore, ok := store.(DigestChartStore)
+	if !ok {
+		return false, nil
+	}
+
+	storedDigest, err := digestStore.Digest(chartName, chartVersion)
+	if err != nil {
+		return false, err
+	}
+	if storedDigest == "" {
+		return false, nil
+	}
+
+	digest, err := c.HelmClient.GetPackageDigest(chartName, chartVersion)
+	if err != nil {
+		return false, err
+	}
+	if digest == storedDigest {
+		return false, nil
+	}
+
+	// Charts are checked again on every resync, the same conflict is reported only once
+	conflictKey := fmt.Sprintf("%s/%s-%s/%s", store.Name(), chartName, chartVersion, storedDigest)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conflicts[conflictKey] {
+		return true, nil
+	}
+	c.conflicts[conflictKey] = true
+
+	zap.L().Sugar().Infof("Chart %s-%s in %s has %s digest, which conflicts with %s digest of the cached chart", chartName, chartVersion, store.Name(), storedDigest, digest)
+	chartConflictsTotal.WithLabelValues(store.Name(), chartName).Inc()
+
+	return true, nil
+}
+
+// resolveConflict applies the conflict policy to the chart which conflicts with the stored one.
+func (c *Collector) resolveConflict(r *entities.HelmRelease, store ChartStore) error {
+	chartName := r.Release.Chart.Metadata.Name
+	chartVersion := r.Release.Chart.Metadata.Version
+
+	switch c.ConflictPolicy {
+	case ConflictPolicyOverwrite:
+		if err := store.Delete(chartName, chartVersion); err != nil {
+			return err
+		}
+		return c.uploadToStore(r, store)
+	case ConflictPolicyRename:
+		digest, err := c.HelmClient.GetPackageDigest(chartName, chartVersion)
+		if err != nil {
+			return err
+		}
+
+		// The suffix is semver build metadata, so the renamed chart has the same precedence
+		renamedVersion := fmt.Sprintf("%s+%s", chartVersion, digest[:8])
+		if strings.Contains(chartVersion, "+") {
+			renamedVersion = fmt.Sprintf("%s.%s", chartVersion, digest[:8])
+		}
+		if c.isUploadedToStore(store, chartName, renamedVersion) {
+			return nil
+		}
+
+		path, err := c.HelmClient.PackageWithVersion(chartName, chartVersion, renamedVersion)
+		if err != nil {
+			return err
+		}
+		packageFile, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer packageFile.Close()
+
+		zap.L().Sugar().Infof("Uploading chart %s-%s to %s as %s version", chartName, chartVersion, store.Name(), renamedVersion)
+		return store.Put(chartName, renamedVersion, packageFile)
+	default:
+		return nil
+	}
+}
+
+func (c *Collector) CheckReleaseRevision(source ReleaseSource, rev *entities.HelmReleaseRevision) {
+	zap.L().Sugar().Infof("Checking %s %s/%s of %s cluster...", rev.Driver, rev.Namespace, rev.ObjectName, rev.Cluster)
+
+	r, err := source.GetRelease(rev)
+	if errors.Is(err, ErrExcludedRelease) {
+		// The revision is marked as checked, so it isn't read again on every scan
+		zap.L().Sugar().Infof("Skipping %s %s/%s of %s cluster: %v", rev.Driver, rev.Namespace, rev.ObjectName, rev.Cluster, err)
+		c.CheckedRevisions[rev.Key()] = rev.Status
+		return
+	}
+	if err != nil {
+		zap.L().Sugar().Infof("Can't decode release from %s %s/%s of %s cluster: %v", rev.Driver, rev.Namespace, rev.ObjectName, rev.Cluster, err)
+		return
+	}
+
+	if status := r.Release.Info.Status.String(); !c.isAllowedStatus(status) {
+		zap.L().Sugar().Infof("Skipping chart %s-%s of release %s/%s with %s status", r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version, r.Release.Namespace, r.Release.Name, status)
+		return
+	}
+
+	if err := c.HelmClient.RecordRelease(r, rev, c.ChartSources[rev.Cluster][fmt.Sprintf("%s/%s", r.Release.Namespace, r.Release.Name)]); err != nil {
+		zap.L().Sugar().Infof("Can't record release %s/%s for %s-%s chart: %v", r.Release.Namespace, r.Release.Name, r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version, err)
+	}
+
+	if c.ConflictPolicy == "" && c.isUploaded(r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version) {
+		zap.L().Sugar().Infof("Chart %s-%s already exists in all remote destinations", r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version)
+		c.setChecked(rev, r)
+		return
+	}
+
+	if err := c.HelmClient.SaveRawChart(r); err != nil {
+		zap.L().Sugar().Infof("Can't save %s-%s chart in local filesystem: %v", r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version, err)
+		return
+	}
+
+	if r.IsPackaged {
+		zap.L().Sugar().Infof("Chart %s-%s is already packaged in local filesystem", r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version)
+	} else {
+		if err := c.HelmClient.Package(r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version); err != nil {
+			zap.L().Sugar().Infof("Can't package %s-%s chart in local filesystem: %v", r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version, err)
+			return
+		}
+		r.IsPackaged = true
+	}
+
+	if c.VerifyCharts {
+		c.verifyPackage(r, rev)
+	}
+
+	if !c.uploadToStores(r) {
+		return
+	}
+
+	c.setChecked(rev, r)
+}
+
+// verifyPackage renders the packaged chart with values of the release revision and logs every resource
+// which differs from the deployed one. Mismatches don't prevent the chart from being uploaded.
+func (c *Collector) verifyPackage(r *entities.HelmRelease, rev *entities.HelmReleaseRevision) {
+	chartName := r.Release.Chart.Metadata.Name
+	chartVersion := r.Release.Chart.Metadata.Version
+
+	mismatches, err := c.HelmClient.VerifyPackage(r)
+	if err != nil {
+		zap.L().Sugar().Infof("Can't verify %s-%s chart against release %s/%s: %v", chartName, chartVersion, r.Release.Namespace, r.Release.Name, err)
+		return
+	}
+
+	if len(mismatches) == 0 {
+		zap.L().Sugar().Infof("Chart %s-%s reproduces manifest of release %s/%s", chartName, chartVersion, r.Release.Namespace, r.Release.Name)
+	} else {
+		chartVerificationFailuresTotal.WithLabelValues(fmt.Sprintf("%s-%s", chartName, chartVersion)).Inc()
+	}
+	for _, m := range mismatches {
+		zap.L().Sugar().Infof("Resource %s of release %s/%s differs from the one rendered from %s-%s chart:\n%s", m.Resource, r.Release.Namespace, r.Release.Name, chartName, chartVersion, m.Diff)
+	}
+
+	if err := c.HelmClient.RecordVerification(r, rev, mismatches); err != nil {
+		zap.L().Sugar().Infof("Can't record verification of %s-%s chart: %v", chartName, chartVersion, err)
+	}
+}
+
+func (c *Collector) setChecked(rev *entities.HelmReleaseRevision, r *entities.HelmRelease) {
+	c.CheckedRevisions[rev.Key()] = rev.Status
+	c.revisionCharts[rev.Key()] = entities.StoredChart{
+		Name:    r.Release.Chart.Metadata.Name,
+		Version: r.Release.Chart.Metadata.Version,
+	}
 }
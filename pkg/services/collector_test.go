@@ -0,0 +1,269 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/turboazot/helm-cache/pkg/entities"
+	"helm.sh/helm/v3/pkg/provenance"
+)
+
+// fakeReleaseSource records revisions requested by the collector and fails to decode them.
+type fakeReleaseSource struct {
+	revisions []*entities.HelmReleaseRevision
+	requested []*entities.HelmReleaseRevision
+}
+
+func (s *fakeReleaseSource) Cluster() string {
+	return "test"
+}
+
+func (s *fakeReleaseSource) Driver() string {
+	return SecretDriver
+}
+
+func (s *fakeReleaseSource) ListRevisions() ([]*entities.HelmReleaseRevision, error) {
+	return s.revisions, nil
+}
+
+func (s *fakeReleaseSource) GetRelease(rev *entities.HelmReleaseRevision) (*entities.HelmRelease, error) {
+	s.requested = append(s.requested, rev)
+	return nil, errors.New("not decoded")
+}
+
+func newTestRevision(revision int, status string) *entities.HelmReleaseRevision {
+	return &entities.HelmReleaseRevision{
+		Cluster:     "test",
+		Driver:      SecretDriver,
+		Namespace:   "default",
+		ReleaseName: "app",
+		Revision:    revision,
+		Status:      status,
+		ObjectName:  fmt.Sprintf("sh.helm.release.v1.app.v%d", revision),
+	}
+}
+
+func TestCheckReleaseRevisionsFiltersStatusesBeforeLastRevision(t *testing.T) {
+	source := &fakeReleaseSource{}
+	c, err := NewCollector(newTestHelmClient(t), nil, "", false, []ReleaseSource{source}, false, []string{"deployed"}, nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed upgrade keeps the previous revision deployed
+	c.checkReleaseRevisions(source, []*entities.HelmReleaseRevision{
+		newTestRevision(1, "deployed"),
+		newTestRevision(2, "failed"),
+	})
+
+	if len(source.requested) != 1 || source.requested[0].Revision != 1 {
+		t.Fatalf("expected only the deployed revision 1 to be checked, got %v", source.requested)
+	}
+}
+
+func TestNewCollectorRejectsUnsupportedReleaseStatus(t *testing.T) {
+	if _, err := NewCollector(newTestHelmClient(t), nil, "", false, nil, false, []string{"deployed", "installed"}, nil, time.Hour); err == nil {
+		t.Fatal("expected unsupported release status to be rejected")
+	}
+}
+
+func TestReportNotInstalledCharts(t *testing.T) {
+	c, err := NewCollector(newTestHelmClient(t), nil, "", false, []ReleaseSource{&fakeReleaseSource{}}, false, nil, nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ChartSources = map[string]map[string]*entities.ChartSource{
+		"test": {
+			"apps/apps-app": {Tool: FluxTool, Namespace: "flux-system", Name: "app", ReleaseNamespace: "apps", StorageNamespace: "flux-system", ReleaseName: "apps-app"},
+		},
+		"failed": {
+			"apps/web": {Tool: FluxTool, Namespace: "apps", Name: "web", ReleaseNamespace: "apps", StorageNamespace: "apps", ReleaseName: "web"},
+		},
+	}
+
+	// Revisions of the release are stored in the namespace of the HelmRelease, not in its target namespace
+	c.reportNotInstalledCharts([]*entities.HelmReleaseRevision{
+		{Cluster: "test", Driver: SecretDriver, Namespace: "flux-system", ReleaseName: "apps-app", Revision: 1},
+	}, map[string]bool{"failed": true})
+
+	if len(c.notInstalled) != 0 {
+		t.Fatalf("expected no charts to be reported as not installed, got %v", c.notInstalled)
+	}
+}
+
+// fakeDigestChartStore keeps packages in memory with their digests.
+type fakeDigestChartStore struct {
+	packages map[string][]byte
+}
+
+func newFakeDigestChartStore() *fakeDigestChartStore {
+	return &fakeDigestChartStore{packages: make(map[string][]byte)}
+}
+
+func (s *fakeDigestChartStore) Name() string {
+	return "fake store"
+}
+
+func (s *fakeDigestChartStore) Exists(chartName string, chartVersion string) (bool, error) {
+	_, ok := s.packages[fmt.Sprintf("%s-%s", chartName, chartVersion)]
+	return ok, nil
+}
+
+func (s *fakeDigestChartStore) Put(chartName string, chartVersion string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.packages[fmt.Sprintf("%s-%s", chartName, chartVersion)] = data
+	return nil
+}
+
+func (s *fakeDigestChartStore) Get(chartName string, chartVersion string) (io.ReadCloser, error) {
+	data, ok := s.packages[fmt.Sprintf("%s-%s", chartName, chartVersion)]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *fakeDigestChartStore) List() ([]entities.StoredChart, error) {
+	return nil, nil
+}
+
+func (s *fakeDigestChartStore) Delete(chartName string, chartVersion string) error {
+	delete(s.packages, fmt.Sprintf("%s-%s", chartName, chartVersion))
+	return nil
+}
+
+func (s *fakeDigestChartStore) Digest(chartName string, chartVersion string) (string, error) {
+	data, ok := s.packages[fmt.Sprintf("%s-%s", chartName, chartVersion)]
+	if !ok {
+		return "", nil
+	}
+	return provenance.Digest(bytes.NewReader(data))
+}
+
+// newConflictingRelease packages the chart of the release and stores a package of the same chart
+// version with different contents in the store.
+func newConflictingRelease(t *testing.T, c *Collector, store *fakeDigestChartStore, chartName string, chartVersion string) *entities.HelmRelease {
+	r := newTestRelease(t, newTestChart(chartName, chartVersion))
+	if err := c.HelmClient.SaveRawChart(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.HelmClient.Package(chartName, chartVersion); err != nil {
+		t.Fatal(err)
+	}
+	r.IsPackaged = true
+
+	stored := newTestChart(chartName, chartVersion)
+	stored.Metadata.Description = "Rebuilt upstream"
+	directory := t.TempDir()
+	saveTestPackage(t, stored, directory)
+	data, err := os.ReadFile(filepath.Join(directory, fmt.Sprintf("%s-%s.tgz", chartName, chartVersion)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.packages[fmt.Sprintf("%s-%s", chartName, chartVersion)] = data
+
+	return r
+}
+
+func newConflictTestCollector(t *testing.T, conflictPolicy string, store ChartStore) *Collector {
+	c, err := NewCollector(newTestHelmClient(t), []ChartStore{store}, conflictPolicy, false, []ReleaseSource{&fakeReleaseSource{}}, false, nil, nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestConflictPolicySkip(t *testing.T) {
+	store := newFakeDigestChartStore()
+	c := newConflictTestCollector(t, ConflictPolicySkip, store)
+	r := newConflictingRelease(t, c, store, "skip", "1.0.0")
+	stored := store.packages["skip-1.0.0"]
+
+	for i := 0; i < 2; i++ {
+		if !c.uploadToStores(r) {
+			t.Fatal("Skipped conflict is reported as a failed upload")
+		}
+	}
+
+	if !bytes.Equal(store.packages["skip-1.0.0"], stored) || len(store.packages) != 1 {
+		t.Fatal("Stored chart has been changed")
+	}
+	// Charts are checked again on every resync, the conflict is counted once
+	if count := testutil.ToFloat64(chartConflictsTotal.WithLabelValues(store.Name(), "skip")); count != 1 {
+		t.Fatalf("Expected the conflict to be counted once, got %v", count)
+	}
+}
+
+func TestConflictPolicyOverwrite(t *testing.T) {
+	store := newFakeDigestChartStore()
+	c := newConflictTestCollector(t, ConflictPolicyOverwrite, store)
+	r := newConflictingRelease(t, c, store, "overwrite", "1.0.0")
+
+	if !c.uploadToStores(r) {
+		t.Fatal("Conflicting chart hasn't been overwritten")
+	}
+
+	digest, err := c.HelmClient.GetPackageDigest("overwrite", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storedDigest, _ := store.Digest("overwrite", "1.0.0"); storedDigest != digest {
+		t.Fatalf("Expected the stored chart to have %s digest of the cached chart, got %s", digest, storedDigest)
+	}
+}
+
+func TestConflictPolicyRename(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		suffix  string
+	}{
+		{name: "rename", version: "1.0.0", suffix: "+"},
+		{name: "rename-build", version: "1.0.0+build", suffix: "."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeDigestChartStore()
+			c := newConflictTestCollector(t, ConflictPolicyRename, store)
+			r := newConflictingRelease(t, c, store, tt.name, tt.version)
+			stored := store.packages[fmt.Sprintf("%s-%s", tt.name, tt.version)]
+
+			if !c.uploadToStores(r) {
+				t.Fatal("Conflicting chart hasn't been renamed")
+			}
+
+			digest, err := c.HelmClient.GetPackageDigest(tt.name, tt.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			renamedVersion := tt.version + tt.suffix + digest[:8]
+			if exists, _ := store.Exists(tt.name, renamedVersion); !exists {
+				t.Fatalf("Chart hasn't been stored as %s version", renamedVersion)
+			}
+			if !bytes.Equal(store.packages[fmt.Sprintf("%s-%s", tt.name, tt.version)], stored) {
+				t.Fatal("Stored chart has been changed")
+			}
+
+			// Renamed charts aren't upstream versions, so they're never used as subcharts
+			path, err := findDependencyPackage([]string{c.HelmClient.PackagedChartsDirectory}, tt.name, ">=1.0.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if filepath.Base(path) == fmt.Sprintf("%s-%s.tgz", tt.name, renamedVersion) {
+				t.Fatalf("Renamed chart %s is used as a subchart", path)
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/turboazot/helm-cache/pkg/entities"
+	"go.uber.org/zap"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	FluxTool   = "flux"
+	ArgoCDTool = "argocd"
+)
+
+var (
+	fluxHelmReleaseResources = []schema.GroupVersionResource{
+		{Group: "helm.toolkit.fluxcd.io", Version: "v2", Resource: "helmreleases"},
+		{Group: "helm.toolkit.fluxcd.io", Version: "v2beta2", Resource: "helmreleases"},
+		{Group: "helm.toolkit.fluxcd.io", Version: "v2beta1", Resource: "helmreleases"},
+	}
+	fluxSourceVersions         = []string{"v1", "v1beta2", "v1beta1"}
+	argoCDApplicationResources = []schema.GroupVersionResource{
+		{Group: "argoproj.io", Version: "v1alpha1", Resource: "applications"},
+	}
+)
+
+// GitOpsClient reads Flux HelmRelease and Argo CD Application resources to find out
+// which repository the charts of Helm releases come from.
+type GitOpsClient struct {
+	ClusterName     string
+	DynamicClient   dynamic.Interface
+	NamespaceFilter *entities.NamespaceFilter
+}
+
+func NewGitOpsClients(clusters []entities.ClusterConfig, namespaceFilter *entities.NamespaceFilter) map[string]*GitOpsClient {
+	gitOpsClients := make(map[string]*GitOpsClient)
+
+	for _, cluster := range clusters {
+		config, err := newKubernetesConfig(cluster)
+		if err != nil {
+			zap.L().Sugar().Infof("Can't load kubeconfig of %s cluster: %v", cluster.Name, err)
+			continue
+		}
+
+		dynamicClient, err := dynamic.NewForConfig(config)
+		if err != nil {
+			zap.L().Sugar().Infof("Can't create kubernetes dynamic client for %s cluster: %v", cluster.Name, err)
+			continue
+		}
+
+		gitOpsClients[cluster.Name] = &GitOpsClient{
+			ClusterName:     cluster.Name,
+			DynamicClient:   dynamicClient,
+			NamespaceFilter: namespaceFilter,
+		}
+	}
+
+	return gitOpsClients
+}
+
+// GetChartSources returns chart sources declared by GitOps resources mapped by release namespace and name.
+// Resources of a GitOps tool which is not installed in the cluster are skipped.
+func (c *GitOpsClient) GetChartSources() (map[string]*entities.ChartSource, error) {
+	sources := make(map[string]*entities.ChartSource)
+
+	helmReleases, err := c.listFirstServed(fluxHelmReleaseResources)
+	if err != nil {
+		return nil, err
+	}
+	for index := range helmReleases {
+		source, err := c.newFluxChartSource(&helmReleases[index])
+		if err != nil {
+			zap.L().Sugar().Infof("Can't get chart source of HelmRelease %s/%s in %s cluster: %v", helmReleases[index].GetNamespace(), helmReleases[index].GetName(), c.ClusterName, err)
+			continue
+		}
+		if source != nil {
+			sources[source.ReleaseKey()] = source
+		}
+	}
+
+	applications, err := c.listFirstServed(argoCDApplicationResources)
+	if err != nil {
+		return nil, err
+	}
+	for index := range applications {
+		for _, source := range newArgoCDChartSources(&applications[index]) {
+			sources[source.ReleaseKey()] = source
+		}
+	}
+
+	return sources, nil
+}
+
+// listFirstServed lists objects of the first resource version served by the cluster. Namespaces
+// are listed one by one when they're known, so namespaced Roles are enough to read the objects.
+func (c *GitOpsClient) listFirstServed(resources []schema.GroupVersionResource) ([]unstructured.Unstructured, error) {
+	for _, resource := range resources {
+		var items []unstructured.Unstructured
+		served := true
+		for _, namespace := range c.NamespaceFilter.ScopedNamespaces() {
+			list, err := c.DynamicClient.Resource(resource).Namespace(namespace).List(context.TODO(), metav1.ListOptions{})
+			if apierrors.IsNotFound(err) {
+				served = false
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, list.Items...)
+		}
+		if !served {
+			continue
+		}
+
+		return items, nil
+	}
+
+	return nil, nil
+}
+
+func (c *GitOpsClient) newFluxChartSource(hr *unstructured.Unstructured) (*entities.ChartSource, error) {
+	chart, _, _ := unstructured.NestedString(hr.Object, "spec", "chart", "spec", "chart")
+	if chart == "" {
+		return nil, nil
+	}
+	version, _, _ := unstructured.NestedString(hr.Object, "spec", "chart", "spec", "version")
+	sourceKind, _, _ := unstructured.NestedString(hr.Object, "spec", "chart", "spec", "sourceRef", "kind")
+	sourceName, _, _ := unstructured.NestedString(hr.Object, "spec", "chart", "spec", "sourceRef", "name")
+	sourceNamespace, _, _ := unstructured.NestedString(hr.Object, "spec", "chart", "spec", "sourceRef", "namespace")
+	if sourceNamespace == "" {
+		sourceNamespace = hr.GetNamespace()
+	}
+
+	targetNamespace, _, _ := unstructured.NestedString(hr.Object, "spec", "targetNamespace")
+	storageNamespace, _, _ := unstructured.NestedString(hr.Object, "spec", "storageNamespace")
+	releaseName, _, _ := unstructured.NestedString(hr.Object, "spec", "releaseName")
+	if releaseName == "" {
+		releaseName = hr.GetName()
+		if targetNamespace != "" {
+			releaseName = fmt.Sprintf("%s-%s", targetNamespace, hr.GetName())
+		}
+	}
+	// Flux stores releases in the namespace of the HelmRelease unless storageNamespace is set
+	releaseNamespace := hr.GetNamespace()
+	if targetNamespace != "" {
+		releaseNamespace = targetNamespace
+	}
+	if storageNamespace == "" {
+		storageNamespace = hr.GetNamespace()
+	}
+
+	repoURL, err := c.getFluxSourceURL(sourceKind, sourceNamespace, sourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &entities.ChartSource{
+		Tool:             FluxTool,
+		Kind:             hr.GetKind(),
+		Namespace:        hr.GetNamespace(),
+		Name:             hr.GetName(),
+		ReleaseNamespace: releaseNamespace,
+		StorageNamespace: storageNamespace,
+		ReleaseName:      releaseName,
+		RepoURL:          repoURL,
+		Chart:            chart,
+		Version:          version,
+	}, nil
+}
+
+// getFluxSourceURL returns URL of the Flux source (HelmRepository, GitRepository, Bucket) the chart is taken from.
+func (c *GitOpsClient) getFluxSourceURL(kind string, namespace string, name string) (string, error) {
+	resource := fmt.Sprintf("%ss", strings.ToLower(kind))
+	if strings.HasSuffix(resource, "ys") {
+		resource = fmt.Sprintf("%sies", strings.TrimSuffix(resource, "ys"))
+	}
+
+	for _, version := range fluxSourceVersions {
+		gvr := schema.GroupVersionResource{Group: "source.toolkit.fluxcd.io", Version: version, Resource: resource}
+		source, err := c.DynamicClient.Resource(gvr).Namespace(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if url, _, _ := unstructured.NestedString(source.Object, "spec", "url"); url != "" {
+			return url, nil
+		}
+		bucketName, _, _ := unstructured.NestedString(source.Object, "spec", "bucketName")
+		endpoint, _, _ := unstructured.NestedString(source.Object, "spec", "endpoint")
+		return fmt.Sprintf("%s/%s", endpoint, bucketName), nil
+	}
+
+	return "", nil
+}
+
+func newArgoCDChartSources(app *unstructured.Unstructured) []*entities.ChartSource {
+	var specSources []map[string]interface{}
+	if source, found, _ := unstructured.NestedMap(app.Object, "spec", "source"); found {
+		specSources = append(specSources, source)
+	}
+	if sources, found, _ := unstructured.NestedSlice(app.Object, "spec", "sources"); found {
+		for _, source := range sources {
+			if s, ok := source.(map[string]interface{}); ok {
+				specSources = append(specSources, s)
+			}
+		}
+	}
+
+	releaseNamespace, _, _ := unstructured.NestedString(app.Object, "spec", "destination", "namespace")
+
+	var sources []*entities.ChartSource
+	for _, specSource := range specSources {
+		repoURL, _, _ := unstructured.NestedString(specSource, "repoURL")
+		chart, _, _ := unstructured.NestedString(specSource, "chart")
+		if _, isHelm, _ := unstructured.NestedMap(specSource, "helm"); chart == "" && isHelm {
+			chart, _, _ = unstructured.NestedString(specSource, "path")
+		}
+		if chart == "" {
+			continue
+		}
+		version, _, _ := unstructured.NestedString(specSource, "targetRevision")
+		releaseName, _, _ := unstructured.NestedString(specSource, "helm", "releaseName")
+		if releaseName == "" {
+			releaseName = app.GetName()
+		}
+
+		sources = append(sources, &entities.ChartSource{
+			Tool:             ArgoCDTool,
+			Kind:             app.GetKind(),
+			Namespace:        app.GetNamespace(),
+			Name:             app.GetName(),
+			ReleaseNamespace: releaseNamespace,
+			StorageNamespace: releaseNamespace,
+			ReleaseName:      releaseName,
+			RepoURL:          repoURL,
+			Chart:            chart,
+			Version:          version,
+		})
+	}
+
+	return sources
+}
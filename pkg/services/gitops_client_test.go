@@ -0,0 +1,138 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/turboazot/helm-cache/pkg/entities"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestNewFluxChartSourceNamespaces(t *testing.T) {
+	repository := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "source.toolkit.fluxcd.io/v1",
+		"kind":       "HelmRepository",
+		"metadata":   map[string]interface{}{"namespace": "flux-system", "name": "charts"},
+		"spec":       map[string]interface{}{"url": "https://charts.example.com"},
+	}}
+	c := &GitOpsClient{
+		ClusterName:     "test",
+		DynamicClient:   dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), repository),
+		NamespaceFilter: entities.NewNamespaceFilter(nil, nil),
+	}
+
+	tests := []struct {
+		name             string
+		spec             map[string]interface{}
+		releaseNamespace string
+		storageNamespace string
+		releaseName      string
+	}{
+		{
+			name:             "defaults",
+			spec:             map[string]interface{}{},
+			releaseNamespace: "flux-system",
+			storageNamespace: "flux-system",
+			releaseName:      "app",
+		},
+		{
+			name:             "target namespace",
+			spec:             map[string]interface{}{"targetNamespace": "apps"},
+			releaseNamespace: "apps",
+			storageNamespace: "flux-system",
+			releaseName:      "apps-app",
+		},
+		{
+			name:             "storage namespace",
+			spec:             map[string]interface{}{"targetNamespace": "apps", "storageNamespace": "apps", "releaseName": "web"},
+			releaseNamespace: "apps",
+			storageNamespace: "apps",
+			releaseName:      "web",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := map[string]interface{}{
+				"chart": map[string]interface{}{"spec": map[string]interface{}{
+					"chart":     "app",
+					"version":   "1.0.0",
+					"sourceRef": map[string]interface{}{"kind": "HelmRepository", "name": "charts"},
+				}},
+			}
+			for key, value := range tt.spec {
+				spec[key] = value
+			}
+			hr := &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "helm.toolkit.fluxcd.io/v2",
+				"kind":       "HelmRelease",
+				"metadata":   map[string]interface{}{"namespace": "flux-system", "name": "app"},
+				"spec":       spec,
+			}}
+
+			source, err := c.newFluxChartSource(hr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if source.ReleaseNamespace != tt.releaseNamespace || source.StorageNamespace != tt.storageNamespace || source.ReleaseName != tt.releaseName {
+				t.Fatalf("expected release %s/%s stored in %s, got %s/%s stored in %s", tt.releaseNamespace, tt.releaseName, tt.storageNamespace, source.ReleaseNamespace, source.ReleaseName, source.StorageNamespace)
+			}
+			if source.RepoURL != "https://charts.example.com" {
+				t.Fatalf("unexpected repository URL %s", source.RepoURL)
+			}
+		})
+	}
+}
+
+func newTestHelmRelease(namespace string, name string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "helm.toolkit.fluxcd.io/v2",
+		"kind":       "HelmRelease",
+		"metadata":   map[string]interface{}{"namespace": namespace, "name": name},
+		"spec": map[string]interface{}{
+			"chart": map[string]interface{}{"spec": map[string]interface{}{
+				"chart":     name,
+				"sourceRef": map[string]interface{}{"kind": "HelmRepository", "name": "charts"},
+			}},
+		},
+	}}
+}
+
+func TestGetChartSourcesListsScopedNamespaces(t *testing.T) {
+	listKinds := map[schema.GroupVersionResource]string{
+		{Group: "argoproj.io", Version: "v1alpha1", Resource: "applications"}: "ApplicationList",
+	}
+	for _, resource := range fluxHelmReleaseResources {
+		listKinds[resource] = "HelmReleaseList"
+	}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds,
+		newTestHelmRelease("apps", "web"),
+		newTestHelmRelease("default", "api"),
+		newTestHelmRelease("other", "db"),
+	)
+	// Namespaced Roles don't allow listing of all namespaces
+	client.PrependReactor("list", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() == "" {
+			return true, nil, apierrors.NewForbidden(action.GetResource().GroupResource(), "", nil)
+		}
+		return false, nil, nil
+	})
+
+	c := &GitOpsClient{
+		ClusterName:     "test",
+		DynamicClient:   client,
+		NamespaceFilter: entities.NewNamespaceFilter([]string{"apps", "default"}, nil),
+	}
+
+	sources, err := c.GetChartSources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 2 || sources["apps/web"] == nil || sources["default/api"] == nil {
+		t.Fatalf("Expected chart sources of apps and default namespaces, got %v", sources)
+	}
+}
@@ -10,17 +10,21 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/turboazot/helm-cache/pkg/entities"
 	"github.com/turboazot/helm-cache/pkg/utils"
 	"helm.sh/helm/v3/pkg/action"
 	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
 	"helm.sh/helm/v3/pkg/cli"
-	"helm.sh/helm/v3/pkg/downloader"
-	"helm.sh/helm/v3/pkg/getter"
-	v1 "k8s.io/api/core/v1"
+	"helm.sh/helm/v3/pkg/provenance"
+	"helm.sh/helm/v3/pkg/registry"
+	"helm.sh/helm/v3/pkg/release"
 
 	"go.uber.org/zap"
+	"sigs.k8s.io/yaml"
 )
 
 func saveHelmReleaseFileCollection(directory string, files *[]*chart.File) error {
@@ -40,9 +44,14 @@ type HelmClient struct {
 	Settings                *cli.EnvSettings
 	RawChartsDirectory      string
 	PackagedChartsDirectory string
+	MetadataDirectory       string
+	// ChartStores are searched for subcharts which aren't in the local cache
+	ChartStores []ChartStore
+	// incompleteCharts are charts whose releases lack subcharts, they're reported only once
+	incompleteCharts sync.Map
 }
 
-func NewHelmClient(homeDirectory string) (*HelmClient, error) {
+func NewHelmClient(homeDirectory string, registryCredentialsFile string) (*HelmClient, error) {
 	rawChartsDirectory := fmt.Sprintf("%s/data/raw", homeDirectory)
 	if err := os.MkdirAll(rawChartsDirectory, 0755); err != nil {
 		return nil, err
@@ -51,26 +60,65 @@ func NewHelmClient(homeDirectory string) (*HelmClient, error) {
 	if err := os.MkdirAll(packagedChartsDirectory, 0755); err != nil {
 		return nil, err
 	}
+	metadataDirectory := fmt.Sprintf("%s/data/metadata", homeDirectory)
+	if err := os.MkdirAll(metadataDirectory, 0755); err != nil {
+		return nil, err
+	}
+
+	var registryClientOptions []registry.ClientOption
+	if registryCredentialsFile != "" {
+		registryClientOptions = append(registryClientOptions, registry.ClientOptCredentialsFile(registryCredentialsFile))
+	}
+	registryClient, err := registry.NewClient(registryClientOptions...)
+	if err != nil {
+		return nil, err
+	}
 
 	return &HelmClient{
-		ActionConfig:            new(action.Configuration),
+		ActionConfig:            &action.Configuration{RegistryClient: registryClient},
 		Settings:                cli.New(),
 		RawChartsDirectory:      rawChartsDirectory,
 		PackagedChartsDirectory: packagedChartsDirectory,
+		MetadataDirectory:       metadataDirectory,
 	}, nil
 }
 
-func (c *HelmClient) GetHelmRelease(s *entities.HelmReleaseSecret) (*entities.HelmRelease, error) {
-	var r entities.HelmRelease
-	r.IsSaved = false
+// DecodeRelease decodes a release encoded by the Helm secret or configmap storage driver.
+func (c *HelmClient) DecodeRelease(data string) (*entities.HelmRelease, error) {
+	decodedBytes, err := decompressRelease(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var rel release.Release
+	err = json.Unmarshal(decodedBytes, &rel)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.newHelmRelease(&rel), nil
+}
+
+// newHelmRelease wraps the release and checks whether its chart is already saved and packaged.
+func (c *HelmClient) newHelmRelease(rel *release.Release) *entities.HelmRelease {
+	r := &entities.HelmRelease{Release: rel}
 
-	if _, releaseKeyExists := s.Data["release"]; !releaseKeyExists {
-		return nil, errors.New(fmt.Sprintf("Release secret %s doesn't contain release key in data", s.Secret.Name))
+	_, err := os.Stat(fmt.Sprintf("%s/%s-%s", c.RawChartsDirectory, rel.Chart.Metadata.Name, rel.Chart.Metadata.Version))
+	if err == nil {
+		r.IsSaved = true
 	}
 
-	var base64DecodedBytes []byte
+	_, err = os.Stat(fmt.Sprintf("%s/%s-%s.tgz", c.PackagedChartsDirectory, rel.Chart.Metadata.Name, rel.Chart.Metadata.Version))
+	if err == nil {
+		r.IsPackaged = true
+	}
 
-	base64DecodedBytes, err := base64.StdEncoding.DecodeString(string(s.Data["release"]))
+	return r
+}
+
+// decompressRelease decodes base64 and gzip encoding which both Helm v2 and v3 apply to stored releases.
+func decompressRelease(data string) ([]byte, error) {
+	base64DecodedBytes, err := base64.StdEncoding.DecodeString(data)
 	if err != nil {
 		return nil, err
 	}
@@ -79,52 +127,87 @@ func (c *HelmClient) GetHelmRelease(s *entities.HelmReleaseSecret) (*entities.He
 	if err != nil {
 		return nil, err
 	}
+	defer g.Close()
 
-	decodedBytes, err := ioutil.ReadAll(g)
-	if err != nil {
-		return nil, err
+	return ioutil.ReadAll(g)
+}
+
+func (c *HelmClient) GetLastRevisionsMap(revisions []*entities.HelmReleaseRevision) map[string]*entities.HelmReleaseRevision {
+	result := make(map[string]*entities.HelmReleaseRevision)
+	for _, rev := range revisions {
+		releaseID := rev.ReleaseID()
+		if lastRevision, releaseExists := result[releaseID]; !releaseExists || lastRevision.Revision < rev.Revision {
+			result[releaseID] = rev
+		}
 	}
 
-	err = json.Unmarshal(decodedBytes, &r.Release)
-	if err != nil {
-		return nil, err
+	return result
+}
+
+// RecordRelease stores the release revision and its status in metadata of the release chart,
+// along with the chart source if it's known.
+func (c *HelmClient) RecordRelease(r *entities.HelmRelease, rev *entities.HelmReleaseRevision, source *entities.ChartSource) error {
+	path := fmt.Sprintf("%s/%s-%s.yaml", c.MetadataDirectory, r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version)
+
+	cc := entities.NewCachedChart(r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version)
+	if err := utils.ReadYamlFromFile(path, cc); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
 	}
 
-	_, err = os.Stat(fmt.Sprintf("%s/%s-%s", c.RawChartsDirectory, r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version))
-	if err == nil {
-		r.IsSaved = true
+	cc.SetRelease(entities.CachedChartRelease{
+		Cluster:   rev.Cluster,
+		Driver:    rev.Driver,
+		Namespace: r.Release.Namespace,
+		Name:      r.Release.Name,
+		Revision:  r.Release.Version,
+		Status:    r.Release.Info.Status.String(),
+	})
+	if source != nil {
+		cc.SetSource(*source)
 	}
 
-	_, err = os.Stat(fmt.Sprintf("%s/%s-%s.tgz", c.PackagedChartsDirectory, r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version))
-	if err == nil {
-		r.IsPackaged = true
+	return utils.WriteYamlToFile(cc, path)
+}
+
+// RecordDestination stores the upload status of the chart in one of chart stores in metadata of the chart.
+func (c *HelmClient) RecordDestination(chartName string, chartVersion string, destination entities.CachedChartDestination) error {
+	path := fmt.Sprintf("%s/%s-%s.yaml", c.MetadataDirectory, chartName, chartVersion)
+
+	cc := entities.NewCachedChart(chartName, chartVersion)
+	if err := utils.ReadYamlFromFile(path, cc); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
 	}
 
-	return &r, nil
+	cc.SetDestination(destination)
+
+	return utils.WriteYamlToFile(cc, path)
 }
 
-func (c *HelmClient) GetLastRevisionReleaseSecretsMap(secrets *v1.SecretList) (map[string]*entities.HelmReleaseSecret, error) {
-	result := make(map[string]*entities.HelmReleaseSecret)
-	releaseIdLastRevisionMap := make(map[string]int)
-	for index, secret := range secrets.Items {
-		if !strings.HasPrefix(secret.Name, "sh.helm.release.v1") {
-			continue
-		}
+// RecordVerification stores the result of verifying the chart against the release revision in metadata of the chart.
+func (c *HelmClient) RecordVerification(r *entities.HelmRelease, rev *entities.HelmReleaseRevision, mismatches []ManifestMismatch) error {
+	path := fmt.Sprintf("%s/%s-%s.yaml", c.MetadataDirectory, r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version)
 
-		rs := entities.NewHelmReleaseSecret(&secrets.Items[index])
-		releaseName, releaseRevision, err := rs.GetReleaseNameAndRevision()
-		if err != nil {
-			return nil, err
-		}
-		releaseNamespace := rs.Secret.Namespace
-		releaseID := fmt.Sprintf("%s-%s", releaseNamespace, releaseName)
-		if _, releaseExists := releaseIdLastRevisionMap[releaseID]; !releaseExists || releaseIdLastRevisionMap[releaseID] < releaseRevision {
-			releaseIdLastRevisionMap[releaseID] = releaseRevision
-			result[releaseID] = rs
-		}
+	cc := entities.NewCachedChart(r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version)
+	if err := utils.ReadYamlFromFile(path, cc); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
 	}
 
-	return result, nil
+	release := entities.CachedChartRelease{
+		Cluster:      rev.Cluster,
+		Driver:       rev.Driver,
+		Namespace:    r.Release.Namespace,
+		Name:         r.Release.Name,
+		Revision:     r.Release.Version,
+		Status:       r.Release.Info.Status.String(),
+		Verification: "passed",
+	}
+	for _, m := range mismatches {
+		release.Verification = "failed"
+		release.Mismatches = append(release.Mismatches, m.Resource)
+	}
+	cc.SetRelease(release)
+
+	return utils.WriteYamlToFile(cc, path)
 }
 
 func (c *HelmClient) SaveRawChart(r *entities.HelmRelease) error {
@@ -134,27 +217,144 @@ func (c *HelmClient) SaveRawChart(r *entities.HelmRelease) error {
 	}
 	directory := fmt.Sprintf("%s/%s-%s", c.RawChartsDirectory, r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version)
 
-	err := utils.WriteYamlToFile(&r.Release.Chart.Values, fmt.Sprintf("%s/%s", directory, "values.yaml"))
+	if err := saveRawChart(directory, r.Release.Chart); err != nil {
+		return err
+	}
+
+	// Only Helm v2 releases embed subcharts, they're resolved on packaging for Helm v3 releases
+	if len(r.Release.Chart.Metadata.Dependencies) > 0 && len(r.Release.Chart.Dependencies()) == 0 {
+		if _, reported := c.incompleteCharts.LoadOrStore(directory, true); !reported {
+			zap.L().Sugar().Infof("Release %s/%s doesn't include subcharts of %s-%s chart, they have to be found in packaged charts, in %s or in chart stores", r.Release.Namespace, r.Release.Name, r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version, c.Settings.RepositoryCache)
+		}
+	}
+
+	r.IsSaved = true
+
+	zap.L().Sugar().Infof("Successfully saved raw chart: %s-%s", r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version)
+
+	return nil
+}
+
+// saveRawChartValues writes the original values.yaml with its comments and key order if the chart
+// keeps it. Charts of stored releases don't keep raw files, as Helm doesn't serialize them, so their
+// parsed values are written instead. The values schema is restored as well.
+func saveRawChartValues(directory string, ch *chart.Chart) error {
+	var err error
+	if values := findFile(ch.Raw, chartutil.ValuesfileName); values != nil {
+		err = utils.WriteStringToFile(fmt.Sprintf("%s/%s", directory, chartutil.ValuesfileName), string(values.Data))
+	} else {
+		err = utils.WriteYamlToFile(&ch.Values, fmt.Sprintf("%s/%s", directory, chartutil.ValuesfileName))
+	}
 	if err != nil {
 		return err
 	}
-	err = utils.WriteYamlToFile(&r.Release.Chart.Metadata, fmt.Sprintf("%s/%s", directory, "Chart.yaml"))
+
+	if len(ch.Schema) == 0 {
+		return nil
+	}
+
+	return utils.WriteStringToFile(fmt.Sprintf("%s/%s", directory, chartutil.SchemafileName), string(ch.Schema))
+}
+
+// saveRawChartMetadata writes Chart.yaml the way Helm does along with dependency files of the chart API
+// version. Dependencies of apiVersion v1 charts go to requirements.yaml and requirements.lock, which are
+// usually kept in files of the chart already. apiVersion v2 charts keep them in Chart.yaml and Chart.lock,
+// the lock is written as is, so its digest still matches the dependencies.
+func saveRawChartMetadata(directory string, ch *chart.Chart) error {
+	metadata := *ch.Metadata
+
+	// Enabled is set by Helm on install according to conditions and tags, it isn't part of the chart
+	metadata.Dependencies = make([]*chart.Dependency, 0, len(ch.Metadata.Dependencies))
+	for _, dependency := range ch.Metadata.Dependencies {
+		d := *dependency
+		d.Enabled = false
+		metadata.Dependencies = append(metadata.Dependencies, &d)
+	}
+	dependencies := metadata.Dependencies
+	if len(dependencies) == 0 || metadata.APIVersion == chart.APIVersionV1 {
+		metadata.Dependencies = nil
+	}
+
+	if err := writeRawChartYaml(directory, chartutil.ChartfileName, &metadata); err != nil {
+		return err
+	}
+
+	if metadata.APIVersion != chart.APIVersionV1 {
+		if ch.Lock == nil {
+			return nil
+		}
+		return writeRawChartYaml(directory, "Chart.lock", ch.Lock)
+	}
+
+	if len(dependencies) > 0 && findFile(ch.Files, "requirements.yaml") == nil {
+		if err := writeRawChartYaml(directory, "requirements.yaml", map[string]interface{}{"dependencies": dependencies}); err != nil {
+			return err
+		}
+	}
+	if ch.Lock != nil && findFile(ch.Files, "requirements.lock") == nil {
+		if err := writeRawChartYaml(directory, "requirements.lock", ch.Lock); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeRawChartYaml marshals chart files with their JSON field names, like Helm does.
+func writeRawChartYaml(directory string, name string, in interface{}) error {
+	data, err := yaml.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	return utils.WriteStringToFile(fmt.Sprintf("%s/%s", directory, name), string(data))
+}
+
+func findFile(files []*chart.File, name string) *chart.File {
+	for _, f := range files {
+		if f.Name == name {
+			return f
+		}
+	}
+
+	return nil
+}
+
+// saveRawChart writes the chart to the directory. Subcharts embedded in the chart are written
+// recursively to charts/<name>, so packaging doesn't need to download them from upstream repositories.
+// Only charts of Helm v2 releases embed subcharts, Helm v3 doesn't store them in releases.
+func saveRawChart(directory string, ch *chart.Chart) error {
+	err := saveRawChartValues(directory, ch)
 	if err != nil {
 		return err
 	}
-	err = saveHelmReleaseFileCollection(directory, &r.Release.Chart.Templates)
+	err = saveRawChartMetadata(directory, ch)
+	if err != nil {
+		return err
+	}
+	err = saveHelmReleaseFileCollection(directory, &ch.Templates)
 	if err != nil {
 		return err
 	}
 
-	err = saveHelmReleaseFileCollection(directory, &r.Release.Chart.Files)
+	err = saveHelmReleaseFileCollection(directory, &ch.Files)
 	if err != nil {
 		return err
 	}
 
-	r.IsSaved = true
+	saved := make(map[string]bool)
+	for _, dependency := range ch.Dependencies() {
+		// Several versions of the same subchart can only be told apart by their versions
+		name := dependency.Name()
+		if saved[name] {
+			name = fmt.Sprintf("%s-%s", dependency.Name(), dependency.Metadata.Version)
+		}
+		saved[name] = true
 
-	zap.L().Sugar().Infof("Successfully saved raw chart: %s-%s", r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version)
+		if err := saveRawChart(fmt.Sprintf("%s/charts/%s", directory, name), dependency); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -167,34 +367,53 @@ func (c *HelmClient) GetReleasePackageFile(r *entities.HelmRelease) (*os.File, e
 	return os.Open(fmt.Sprintf("%s/%s-%s.tgz", c.PackagedChartsDirectory, r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version))
 }
 
-func (c *HelmClient) Package(chartName string, chartVersion string) error {
-	path := fmt.Sprintf("%s/%s-%s", c.RawChartsDirectory, chartName, chartVersion)
+// GetPackageDigest returns the sha256 digest of the packaged chart.
+func (c *HelmClient) GetPackageDigest(chartName string, chartVersion string) (string, error) {
+	return provenance.DigestFile(fmt.Sprintf("%s/%s-%s.tgz", c.PackagedChartsDirectory, chartName, chartVersion))
+}
 
-	client := action.NewPackage()
+// PackageWithVersion packages a copy of the packaged chart with another version and returns its path.
+func (c *HelmClient) PackageWithVersion(chartName string, chartVersion string, newVersion string) (string, error) {
+	ch, err := loader.Load(fmt.Sprintf("%s/%s-%s.tgz", c.PackagedChartsDirectory, chartName, chartVersion))
+	if err != nil {
+		return "", err
+	}
+	ch.Metadata.Version = newVersion
 
-	w := zap.NewStdLog(zap.L()).Writer()
+	return saveChartArchive(ch, c.PackagedChartsDirectory)
+}
 
-	client.RepositoryConfig = c.Settings.RepositoryConfig
-	client.RepositoryCache = c.Settings.RepositoryCache
-	client.Destination = c.PackagedChartsDirectory
+// Package packages the raw chart with its subcharts. Subcharts which aren't saved next to the chart
+// are taken from the local cache, the Helm repository cache or the chart stores. It never reaches out to chart repositories,
+// so charts can be packaged when their upstream repositories are gone. A chart with missing subcharts
+// isn't packaged, as it can't be installed.
+func (c *HelmClient) Package(chartName string, chartVersion string) error {
+	path := fmt.Sprintf("%s/%s-%s", c.RawChartsDirectory, chartName, chartVersion)
 
-	downloadManager := &downloader.Manager{
-		Out:              w,
-		ChartPath:        path,
-		Keyring:          client.Keyring,
-		SkipUpdate:       false,
-		Getters:          getter.All(c.Settings),
-		RegistryClient:   c.ActionConfig.RegistryClient,
-		RepositoryConfig: c.Settings.RepositoryConfig,
-		RepositoryCache:  c.Settings.RepositoryCache,
-		Debug:            c.Settings.Debug,
+	ch, err := loader.LoadDir(path)
+	if err != nil {
+		return err
 	}
 
-	if err := downloadManager.Update(); err != nil {
-		return err
+	if reqs := ch.Metadata.Dependencies; reqs != nil {
+		missing, err := c.resolveDependencies(path, ch)
+		if err != nil {
+			return err
+		}
+		if len(missing) > 0 {
+			return errors.New(fmt.Sprintf("Dependencies %s of %s-%s chart can't be found in packaged charts, in %s or in chart stores", strings.Join(missing, ", "), chartName, chartVersion, c.Settings.RepositoryCache))
+		}
+
+		ch, err = loader.LoadDir(path)
+		if err != nil {
+			return err
+		}
+		if err := action.CheckDependencies(ch, reqs); err != nil {
+			return err
+		}
 	}
 
-	p, err := client.Run(path, make(map[string]interface{}))
+	p, err := saveChartArchive(ch, c.PackagedChartsDirectory)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,466 @@
+package services
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/turboazot/helm-cache/pkg/entities"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+)
+
+type offlineTransport struct {
+	t *testing.T
+}
+
+func (o offlineTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	o.t.Errorf("Unexpected request to %s", r.URL)
+	return nil, errors.New("network is disabled")
+}
+
+// disableNetwork fails the test on any HTTP request made through the default transport.
+func disableNetwork(t *testing.T) {
+	transport := http.DefaultTransport
+	http.DefaultTransport = offlineTransport{t: t}
+	t.Cleanup(func() {
+		http.DefaultTransport = transport
+	})
+}
+
+func newTestHelmClient(t *testing.T) *HelmClient {
+	c, err := NewHelmClient(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Settings.RepositoryCache = t.TempDir()
+
+	return c
+}
+
+func newTestChart(name string, version string, dependencies ...*chart.Chart) *chart.Chart {
+	ch := &chart.Chart{
+		Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: name, Version: version},
+		Values:   map[string]interface{}{"port": 80},
+		Templates: []*chart.File{
+			{Name: "templates/service.yaml", Data: []byte("apiVersion: v1\nkind: Service\nmetadata:\n  name: {{ .Release.Name }}-" + name + "\nspec:\n  ports:\n    - port: {{ .Values.port }}\n")},
+		},
+	}
+	for _, dependency := range dependencies {
+		ch.Metadata.Dependencies = append(ch.Metadata.Dependencies, &chart.Dependency{
+			Name:       dependency.Name(),
+			Version:    dependency.Metadata.Version,
+			Repository: "https://charts.example.com",
+		})
+		ch.AddDependency(dependency)
+	}
+
+	return ch
+}
+
+// compressRelease encodes the release data the way Helm storage drivers and Tiller store it,
+// it's the reverse of decompressRelease.
+func compressRelease(t *testing.T, data []byte) string {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// newTestRelease creates a release the way Helm v3 stores it, without subcharts of its chart.
+func newTestRelease(t *testing.T, ch *chart.Chart) *entities.HelmRelease {
+	data, err := json.Marshal(&release.Release{
+		Name:      "test",
+		Namespace: "default",
+		Version:   1,
+		Info:      &release.Info{Status: release.StatusDeployed},
+		Chart:     ch,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rel release.Release
+	if err := json.Unmarshal(data, &rel); err != nil {
+		t.Fatal(err)
+	}
+
+	return &entities.HelmRelease{Release: &rel}
+}
+
+func saveTestPackage(t *testing.T, ch *chart.Chart, directory string) {
+	if _, err := saveChartArchive(ch, directory); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPackageResolvesDependenciesOffline(t *testing.T) {
+	disableNetwork(t)
+	c := newTestHelmClient(t)
+
+	ch := newTestChart("wordpress", "15.0.0", newTestChart("mariadb", "11.0.0"), newTestChart("common", "2.0.0"))
+	ch.Metadata.Dependencies[0].Version = "11.x.x"
+	ch.Lock = &chart.Lock{Dependencies: []*chart.Dependency{{Name: "common", Version: "2.0.0"}}}
+
+	saveTestPackage(t, newTestChart("mariadb", "10.0.0"), c.PackagedChartsDirectory)
+	saveTestPackage(t, newTestChart("mariadb", "11.0.0"), c.PackagedChartsDirectory)
+	saveTestPackage(t, newTestChart("common", "2.1.0"), c.Settings.RepositoryCache)
+	saveTestPackage(t, newTestChart("common", "2.0.0"), c.Settings.RepositoryCache)
+
+	r := newTestRelease(t, ch)
+	if len(r.Release.Chart.Dependencies()) != 0 {
+		t.Fatal("Subcharts are stored in the release")
+	}
+
+	if err := c.SaveRawChart(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Package("wordpress", "15.0.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	packaged, err := loader.Load(filepath.Join(c.PackagedChartsDirectory, "wordpress-15.0.0.tgz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions := make(map[string]string)
+	for _, dependency := range packaged.Dependencies() {
+		versions[dependency.Name()] = dependency.Metadata.Version
+	}
+	if versions["mariadb"] != "11.0.0" || versions["common"] != "2.0.0" || len(versions) != 2 {
+		t.Errorf("Unexpected subcharts %v, mariadb-11.0.0 and common-2.0.0 are expected", versions)
+	}
+}
+
+func TestPackageResolvesDependenciesFromChartStores(t *testing.T) {
+	disableNetwork(t)
+	c := newTestHelmClient(t)
+
+	store, err := NewLocalChartStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	saveTestPackage(t, newTestChart("mariadb", "11.0.0"), store.Directory)
+	saveTestPackage(t, newTestChart("mariadb", "11.1.0"), store.Directory)
+	saveTestPackage(t, newTestChart("mariadb", "12.0.0"), store.Directory)
+	c.ChartStores = []ChartStore{store}
+
+	ch := newTestChart("wordpress", "15.0.0", newTestChart("mariadb", "11.1.0"))
+	ch.Metadata.Dependencies[0].Version = "11.x.x"
+
+	if err := c.SaveRawChart(newTestRelease(t, ch)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Package("wordpress", "15.0.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	packaged, err := loader.Load(filepath.Join(c.PackagedChartsDirectory, "wordpress-15.0.0.tgz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packaged.Dependencies()) != 1 || packaged.Dependencies()[0].Metadata.Version != "11.1.0" {
+		t.Fatalf("Unexpected subcharts %v, mariadb-11.1.0 is expected", packaged.Metadata.Dependencies)
+	}
+	// Subcharts taken from chart stores are found in the local cache next time
+	if _, err := os.Stat(filepath.Join(c.PackagedChartsDirectory, "mariadb-11.1.0.tgz")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPackageFailsWithMissingDependencies(t *testing.T) {
+	disableNetwork(t)
+	c := newTestHelmClient(t)
+
+	ch := newTestChart("wordpress", "15.0.0", newTestChart("mariadb", "11.0.0"))
+	saveTestPackage(t, newTestChart("mariadb", "10.0.0"), c.PackagedChartsDirectory)
+	saveTestPackage(t, newTestChart("mariadb-galera", "11.0.0"), c.PackagedChartsDirectory)
+
+	if err := c.SaveRawChart(newTestRelease(t, ch)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Package("wordpress", "15.0.0"); err == nil {
+		t.Fatal("Chart is packaged without mariadb subchart")
+	}
+
+	if _, err := os.Stat(filepath.Join(c.PackagedChartsDirectory, "wordpress-15.0.0.tgz")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Incomplete package exists: %v", err)
+	}
+}
+
+// installTestPackage renders the packaged chart the way helm install does and returns its manifest.
+func installTestPackage(t *testing.T, c *HelmClient, chartName string, chartVersion string) string {
+	ch, err := loader.Load(filepath.Join(c.PackagedChartsDirectory, fmt.Sprintf("%s-%s.tgz", chartName, chartVersion)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	install := action.NewInstall(&action.Configuration{
+		Releases:     storage.Init(driver.NewMemory()),
+		Capabilities: chartutil.DefaultCapabilities,
+	})
+	install.DryRun = true
+	install.ClientOnly = true
+	install.ReleaseName = "test"
+	install.Namespace = "default"
+
+	rel, err := install.Run(ch, map[string]interface{}{"mariadb": map[string]interface{}{"port": 3306}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rel.Manifest
+}
+
+func TestPackageEmbeddedSubcharts(t *testing.T) {
+	disableNetwork(t)
+	c := newTestHelmClient(t)
+
+	// Helm v2 releases embed subcharts with their own subcharts
+	ch := newTestChart("wordpress", "15.0.0", newTestChart("mariadb", "11.0.0", newTestChart("common", "2.0.0")))
+	r := &entities.HelmRelease{Release: &release.Release{Name: "test", Namespace: "default", Chart: ch}}
+
+	if err := c.SaveRawChart(r); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"charts/mariadb/Chart.yaml", "charts/mariadb/charts/common/Chart.yaml"} {
+		if _, err := os.Stat(filepath.Join(c.RawChartsDirectory, "wordpress-15.0.0", name)); err != nil {
+			t.Errorf("Subchart isn't saved: %v", err)
+		}
+	}
+
+	if err := c.Package("wordpress", "15.0.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := installTestPackage(t, c, "wordpress", "15.0.0")
+	for _, expected := range []string{"name: test-wordpress", "name: test-mariadb", "port: 3306", "name: test-common"} {
+		if !strings.Contains(manifest, expected) {
+			t.Errorf("Manifest of the reconstructed chart doesn't contain %q:\n%s", expected, manifest)
+		}
+	}
+}
+
+func TestPackageReconstructedUmbrellaChart(t *testing.T) {
+	disableNetwork(t)
+	c := newTestHelmClient(t)
+
+	// Helm v3 releases lose subcharts, they're taken from charts cached from other releases
+	ch := newTestChart("wordpress", "15.0.0", newTestChart("mariadb", "11.0.0"))
+	saveTestPackage(t, newTestChart("mariadb", "11.0.0"), c.PackagedChartsDirectory)
+
+	if err := c.SaveRawChart(newTestRelease(t, ch)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Package("wordpress", "15.0.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := installTestPackage(t, c, "wordpress", "15.0.0")
+	for _, expected := range []string{"name: test-wordpress", "name: test-mariadb", "port: 3306"} {
+		if !strings.Contains(manifest, expected) {
+			t.Errorf("Manifest of the reconstructed chart doesn't contain %q:\n%s", expected, manifest)
+		}
+	}
+}
+
+func chartFiles(files []*chart.File) map[string]string {
+	result := make(map[string]string)
+	for _, f := range files {
+		result[f.Name] = string(f.Data)
+	}
+
+	return result
+}
+
+// assertRawChartRoundTrip saves the chart, loads it back the way helm does and compares it with the original.
+func assertRawChartRoundTrip(t *testing.T, ch *chart.Chart) *chart.Chart {
+	directory := filepath.Join(t.TempDir(), ch.Name())
+	if err := saveRawChart(directory, ch); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loader.Load(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedMetadata := *ch.Metadata
+	expectedMetadata.Dependencies = nil
+	for _, dependency := range ch.Metadata.Dependencies {
+		d := *dependency
+		d.Enabled = false
+		expectedMetadata.Dependencies = append(expectedMetadata.Dependencies, &d)
+	}
+	if !reflect.DeepEqual(loaded.Metadata, &expectedMetadata) {
+		t.Errorf("Metadata of %s chart differs:\n%+v\n%+v", ch.Name(), loaded.Metadata, &expectedMetadata)
+	}
+
+	if (loaded.Lock == nil) != (ch.Lock == nil) {
+		t.Errorf("Lock of %s chart differs: %+v, %+v", ch.Name(), loaded.Lock, ch.Lock)
+	} else if ch.Lock != nil {
+		if loaded.Lock.Digest != ch.Lock.Digest || !loaded.Lock.Generated.Equal(ch.Lock.Generated) || !reflect.DeepEqual(loaded.Lock.Dependencies, ch.Lock.Dependencies) {
+			t.Errorf("Lock of %s chart differs: %+v, %+v", ch.Name(), loaded.Lock, ch.Lock)
+		}
+	}
+
+	if !reflect.DeepEqual(loaded.Values, ch.Values) {
+		t.Errorf("Values of %s chart differ: %v, %v", ch.Name(), loaded.Values, ch.Values)
+	}
+	if string(loaded.Schema) != string(ch.Schema) {
+		t.Errorf("Schema of %s chart differs: %s, %s", ch.Name(), loaded.Schema, ch.Schema)
+	}
+	if !reflect.DeepEqual(chartFiles(loaded.Templates), chartFiles(ch.Templates)) {
+		t.Errorf("Templates of %s chart differ: %v, %v", ch.Name(), chartFiles(loaded.Templates), chartFiles(ch.Templates))
+	}
+
+	// Dependency files of v1 charts are restored next to other files
+	files := chartFiles(ch.Files)
+	for name, data := range chartFiles(loaded.Files) {
+		if expected, ok := files[name]; ok && expected != data {
+			t.Errorf("File %s of %s chart differs: %s, %s", name, ch.Name(), data, expected)
+		}
+		delete(files, name)
+	}
+	if len(files) > 0 {
+		t.Errorf("Files of %s chart are missing: %v", ch.Name(), files)
+	}
+
+	if len(loaded.Dependencies()) != len(ch.Dependencies()) {
+		t.Fatalf("Subcharts of %s chart differ: %d, %d", ch.Name(), len(loaded.Dependencies()), len(ch.Dependencies()))
+	}
+
+	return loaded
+}
+
+func newRoundTripChart(apiVersion string) *chart.Chart {
+	ch := &chart.Chart{
+		Metadata: &chart.Metadata{
+			APIVersion:  apiVersion,
+			Name:        "app",
+			Version:     "1.2.3",
+			AppVersion:  "4.5.6",
+			Description: "Application",
+			Keywords:    []string{"app"},
+			Maintainers: []*chart.Maintainer{{Name: "maintainer", Email: "maintainer@example.com"}},
+			Annotations: map[string]string{"category": "Application"},
+			Dependencies: []*chart.Dependency{
+				{Name: "sub", Version: "~1.0.0", Repository: "https://charts.example.com", Condition: "sub.enabled", Tags: []string{"backend"}, Enabled: true},
+			},
+		},
+		Lock: &chart.Lock{
+			Generated:    time.Date(2022, 6, 1, 12, 30, 0, 0, time.UTC),
+			Digest:       "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			Dependencies: []*chart.Dependency{{Name: "sub", Version: "1.0.1", Repository: "https://charts.example.com"}},
+		},
+		Values: map[string]interface{}{
+			"replicas": float64(2),
+			"image":    map[string]interface{}{"repository": "app", "tag": "4.5.6"},
+			"sub":      map[string]interface{}{"enabled": true},
+		},
+		Schema: []byte(`{"type":"object","required":["replicas"]}`),
+		Templates: []*chart.File{
+			{Name: "templates/_helpers.tpl", Data: []byte(`{{ define "app.name" }}app{{ end }}`)},
+			{Name: "templates/deployment.yaml", Data: []byte("kind: Deployment\nmetadata:\n  name: {{ include \"app.name\" . }}\n")},
+		},
+		Files: []*chart.File{
+			{Name: "README.md", Data: []byte("# App\n")},
+			{Name: "crds/crd.yaml", Data: []byte("kind: CustomResourceDefinition\n")},
+			{Name: "files/config.json", Data: []byte(`{"key":"value"}`)},
+		},
+	}
+	ch.AddDependency(newTestChart("sub", "1.0.1"))
+	ch.Dependencies()[0].Metadata.APIVersion = apiVersion
+
+	return ch
+}
+
+func TestSaveRawChartRoundTripV2(t *testing.T) {
+	ch := newRoundTripChart(chart.APIVersionV2)
+	loaded := assertRawChartRoundTrip(t, ch)
+
+	if loaded.Dependencies()[0].Metadata.Version != "1.0.1" {
+		t.Errorf("Unexpected subchart %s-%s", loaded.Dependencies()[0].Name(), loaded.Dependencies()[0].Metadata.Version)
+	}
+}
+
+func TestSaveRawChartKeepsLockDigest(t *testing.T) {
+	ch := newRoundTripChart(chart.APIVersionV2)
+	directory := filepath.Join(t.TempDir(), ch.Name())
+	if err := saveRawChart(directory, ch); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(directory, "Chart.lock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "digest: "+ch.Lock.Digest) {
+		t.Errorf("Chart.lock doesn't keep the digest:\n%s", data)
+	}
+
+	data, err = os.ReadFile(filepath.Join(directory, chartutil.ChartfileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "enabled: ") {
+		t.Errorf("Chart.yaml keeps enabled field of dependencies:\n%s", data)
+	}
+}
+
+func TestSaveRawChartRoundTripV1(t *testing.T) {
+	ch := newRoundTripChart(chart.APIVersionV1)
+	loaded := assertRawChartRoundTrip(t, ch)
+
+	files := chartFiles(loaded.Files)
+	if _, ok := files["requirements.yaml"]; !ok {
+		t.Error("requirements.yaml isn't restored")
+	}
+	if _, ok := files["requirements.lock"]; !ok {
+		t.Error("requirements.lock isn't restored")
+	}
+
+	// Dependencies of v1 charts are only kept in requirements.yaml
+	if metadata := findFile(loaded.Raw, chartutil.ChartfileName); metadata == nil || strings.Contains(string(metadata.Data), "dependencies") {
+		t.Errorf("Chart.yaml keeps dependencies of v1 chart")
+	}
+}
+
+func TestSaveRawChartRoundTripV1KeepsRequirementFiles(t *testing.T) {
+	ch := newRoundTripChart(chart.APIVersionV1)
+	requirements := "# Original requirements\ndependencies:\n- name: sub\n  version: ~1.0.0\n  repository: https://charts.example.com\n  condition: sub.enabled\n  tags:\n  - backend\n"
+	lock := "dependencies:\n- name: sub\n  repository: https://charts.example.com\n  version: 1.0.1\ndigest: " + ch.Lock.Digest + "\ngenerated: \"2022-06-01T12:30:00Z\"\n"
+	ch.Files = append(ch.Files,
+		&chart.File{Name: "requirements.yaml", Data: []byte(requirements)},
+		&chart.File{Name: "requirements.lock", Data: []byte(lock)},
+	)
+
+	loaded := assertRawChartRoundTrip(t, ch)
+
+	files := chartFiles(loaded.Files)
+	if files["requirements.yaml"] != requirements || files["requirements.lock"] != lock {
+		t.Errorf("Requirement files aren't kept as is:\n%s\n%s", files["requirements.yaml"], files["requirements.lock"])
+	}
+}
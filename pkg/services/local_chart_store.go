@@ -0,0 +1,114 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/turboazot/helm-cache/pkg/entities"
+	"github.com/turboazot/helm-cache/pkg/utils"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/provenance"
+
+	"go.uber.org/zap"
+)
+
+// LocalChartStore copies packaged charts to a directory, e.g. a mounted network share.
+type LocalChartStore struct {
+	Directory string
+}
+
+func NewLocalChartStore(directory string) (*LocalChartStore, error) {
+	s := &LocalChartStore{Directory: directory}
+
+	if !s.IsActive() {
+		return s, nil
+	}
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *LocalChartStore) IsActive() bool {
+	return s.Directory != ""
+}
+
+func (s *LocalChartStore) Name() string {
+	return fmt.Sprintf("directory %s", s.Directory)
+}
+
+func (s *LocalChartStore) path(chartName string, chartVersion string) string {
+	return filepath.Join(s.Directory, fmt.Sprintf("%s-%s.tgz", chartName, chartVersion))
+}
+
+func (s *LocalChartStore) Exists(chartName string, chartVersion string) (bool, error) {
+	_, err := os.Stat(s.path(chartName, chartVersion))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// Put writes the package to a temporary file first, so a partially written package is never visible.
+func (s *LocalChartStore) Put(chartName string, chartVersion string, r io.Reader) error {
+	err := utils.WriteFileAtomically(s.path(chartName, chartVersion), func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	zap.L().Sugar().Infof("Successfully copied chart %s-%s to %s", chartName, chartVersion, s.Directory)
+
+	return nil
+}
+
+func (s *LocalChartStore) Get(chartName string, chartVersion string) (io.ReadCloser, error) {
+	return os.Open(s.path(chartName, chartVersion))
+}
+
+func (s *LocalChartStore) Digest(chartName string, chartVersion string) (string, error) {
+	return provenance.DigestFile(s.path(chartName, chartVersion))
+}
+
+// List loads metadata of every package in the directory, as chart names and versions
+// can't be reliably split from file names.
+func (s *LocalChartStore) List() ([]entities.StoredChart, error) {
+	paths, err := filepath.Glob(filepath.Join(s.Directory, "*.tgz"))
+	if err != nil {
+		return nil, err
+	}
+
+	var charts []entities.StoredChart
+	for _, path := range paths {
+		ch, err := loader.LoadFile(path)
+		if err != nil {
+			zap.L().Sugar().Infof("Can't load chart %s: %v", path, err)
+			continue
+		}
+
+		digest, err := provenance.DigestFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		charts = append(charts, entities.StoredChart{
+			Name:    ch.Metadata.Name,
+			Version: ch.Metadata.Version,
+			Digest:  digest,
+		})
+	}
+
+	return charts, nil
+}
+
+func (s *LocalChartStore) Delete(chartName string, chartVersion string) error {
+	return os.Remove(s.path(chartName, chartVersion))
+}
@@ -0,0 +1,41 @@
+package services
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalChartStorePut(t *testing.T) {
+	s, err := NewLocalChartStore(filepath.Join(t.TempDir(), "charts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Put("app", "1.0.0", strings.NewReader("package")); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(s.Directory, "app-1.0.0.tgz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("Unexpected mode of the package: %v", info.Mode().Perm())
+	}
+
+	files, err := ioutil.ReadDir(s.Directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("Temporary files are left in the directory: %d files", len(files))
+	}
+
+	exists, err := s.Exists("app", "1.0.0")
+	if err != nil || !exists {
+		t.Errorf("Package doesn't exist: %v", err)
+	}
+}
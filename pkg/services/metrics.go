@@ -0,0 +1,31 @@
+package services
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"go.uber.org/zap"
+)
+
+var chartConflictsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "helm_cache_chart_conflicts_total",
+	Help: "Number of charts found in a chart store with the same name and version but different contents.",
+}, []string{"store", "chart"})
+
+var chartVerificationFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "helm_cache_chart_verification_failures_total",
+	Help: "Number of release revisions whose manifest differs from the manifest rendered from the cached chart.",
+}, []string{"chart"})
+
+// ServeMetrics serves Prometheus metrics on /metrics until the server fails.
+func ServeMetrics(address string) error {
+	zap.L().Sugar().Infof("Serving metrics on %s", address)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	return http.ListenAndServe(address, mux)
+}
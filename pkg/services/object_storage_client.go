@@ -0,0 +1,367 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/turboazot/helm-cache/pkg/entities"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/provenance"
+	"helm.sh/helm/v3/pkg/repo"
+	"sigs.k8s.io/yaml"
+
+	"go.uber.org/zap"
+)
+
+const (
+	indexFileName = "index.yaml"
+
+	// indexUpdateAttempts limits retries of index updates which lost the race to another helm-cache instance
+	indexUpdateAttempts = 10
+	// indexCacheTTL is how long chart versions of index.yaml are trusted, so charts deleted by others are noticed
+	indexCacheTTL = time.Minute
+)
+
+// ObjectStorageClient stores packaged charts in a bucket of an S3-compatible object storage and
+// maintains index.yaml next to them, so the bucket can be added as a Helm repository.
+type ObjectStorageClient struct {
+	Client            *minio.Client
+	Bucket            string
+	Prefix            string
+	ChartVersionCache map[string]bool
+	cacheTime         time.Time
+	mutex             sync.Mutex
+}
+
+func NewObjectStorageClient(endpoint string, bucket string, prefix string, region string, accessKey string, secretKey string, insecure bool, tlsConfig *tls.Config) (*ObjectStorageClient, error) {
+	c := &ObjectStorageClient{
+		Bucket:            bucket,
+		Prefix:            strings.Trim(prefix, "/"),
+		ChartVersionCache: make(map[string]bool),
+	}
+
+	if !c.IsActive() {
+		return c, nil
+	}
+
+	if endpoint == "" {
+		return nil, errors.New("Object storage endpoint is required")
+	}
+
+	// Credentials are taken from the environment, e.g. AWS_ACCESS_KEY_ID or IAM roles, unless they're given
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		&credentials.IAM{Client: &http.Client{Transport: http.DefaultTransport}},
+	})
+	if accessKey != "" && secretKey != "" {
+		creds = credentials.NewStaticV4(accessKey, secretKey, "")
+	}
+
+	transport, err := minio.DefaultTransport(!insecure)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:     creds,
+		Secure:    !insecure,
+		Region:    region,
+		Transport: transport,
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.Client = client
+
+	exists, err := client.BucketExists(context.Background(), bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.New(fmt.Sprintf("Bucket %s doesn't exist", bucket))
+	}
+
+	if err := c.Refresh(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Refresh reloads chart versions listed in index.yaml of the bucket.
+func (c *ObjectStorageClient) Refresh() error {
+	index, _, err := c.getIndex()
+	if err != nil {
+		return err
+	}
+
+	chartVersionCache := make(map[string]bool)
+	for chartName, chartVersions := range index.Entries {
+		for _, chartVersion := range chartVersions {
+			chartVersionCache[fmt.Sprintf("%s-%s", chartName, chartVersion.Version)] = true
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.ChartVersionCache = chartVersionCache
+	c.cacheTime = time.Now()
+
+	return nil
+}
+
+func (c *ObjectStorageClient) setCached(chartName string, chartVersion string, exists bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if exists {
+		c.ChartVersionCache[fmt.Sprintf("%s-%s", chartName, chartVersion)] = true
+	} else {
+		delete(c.ChartVersionCache, fmt.Sprintf("%s-%s", chartName, chartVersion))
+	}
+}
+
+// isCached reports whether the chart version is cached and the cache is still fresh.
+func (c *ObjectStorageClient) isCached(chartName string, chartVersion string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.ChartVersionCache[fmt.Sprintf("%s-%s", chartName, chartVersion)] && time.Since(c.cacheTime) < indexCacheTTL
+}
+
+func (c *ObjectStorageClient) IsActive() bool {
+	return c.Bucket != ""
+}
+
+func (c *ObjectStorageClient) objectName(name string) string {
+	return path.Join(c.Prefix, name)
+}
+
+func (c *ObjectStorageClient) Name() string {
+	return fmt.Sprintf("bucket %s", c.Bucket)
+}
+
+// Exists reports whether the chart version is listed in index.yaml of the bucket. The index is read
+// again when the chart version is missing or the cached index is outdated, as other helm-cache
+// instances and users of the bucket change it too.
+func (c *ObjectStorageClient) Exists(chartName string, chartVersion string) (bool, error) {
+	if c.isCached(chartName, chartVersion) {
+		return true, nil
+	}
+
+	if err := c.Refresh(); err != nil {
+		return false, err
+	}
+
+	return c.isCached(chartName, chartVersion), nil
+}
+
+// Put puts the packaged chart into the bucket and adds it to index.yaml.
+func (c *ObjectStorageClient) Put(chartName string, chartVersion string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	ch, err := loader.LoadArchive(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	digest, err := provenance.Digest(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	fileName := fmt.Sprintf("%s-%s.tgz", chartName, chartVersion)
+	_, err = c.Client.PutObject(context.Background(), c.Bucket, c.objectName(fileName), bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType: "application/gzip",
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := c.updateIndex(func(index *repo.IndexFile) error {
+		if index.Has(chartName, chartVersion) {
+			return nil
+		}
+		return index.MustAdd(ch.Metadata, fileName, "", digest)
+	}); err != nil {
+		return err
+	}
+
+	c.setCached(chartName, chartVersion, true)
+
+	zap.L().Sugar().Infof("Successfully uploaded chart %s-%s to %s bucket", chartName, chartVersion, c.Bucket)
+
+	return nil
+}
+
+func (c *ObjectStorageClient) Get(chartName string, chartVersion string) (io.ReadCloser, error) {
+	object, err := c.Client.GetObject(context.Background(), c.Bucket, c.objectName(fmt.Sprintf("%s-%s.tgz", chartName, chartVersion)), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// GetObject is lazy, errors like a missing object are returned only after the object is requested
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		return nil, err
+	}
+
+	return object, nil
+}
+
+// Digest returns the digest of the chart version listed in index.yaml of the bucket.
+func (c *ObjectStorageClient) Digest(chartName string, chartVersion string) (string, error) {
+	index, _, err := c.getIndex()
+	if err != nil {
+		return "", err
+	}
+
+	chart, err := index.Get(chartName, chartVersion)
+	if err != nil {
+		return "", err
+	}
+
+	return chart.Digest, nil
+}
+
+// List returns the chart versions listed in index.yaml of the bucket.
+func (c *ObjectStorageClient) List() ([]entities.StoredChart, error) {
+	index, _, err := c.getIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	var charts []entities.StoredChart
+	for chartName, chartVersions := range index.Entries {
+		for _, chartVersion := range chartVersions {
+			charts = append(charts, entities.StoredChart{
+				Name:    chartName,
+				Version: chartVersion.Version,
+				Digest:  chartVersion.Digest,
+			})
+		}
+	}
+
+	return charts, nil
+}
+
+// Delete removes the chart version from index.yaml first, so the repository never refers to a missing package.
+func (c *ObjectStorageClient) Delete(chartName string, chartVersion string) error {
+	err := c.updateIndex(func(index *repo.IndexFile) error {
+		versions := index.Entries[chartName]
+		for i, v := range versions {
+			if v.Version == chartVersion {
+				versions = append(versions[:i], versions[i+1:]...)
+				break
+			}
+		}
+		if len(versions) == 0 {
+			delete(index.Entries, chartName)
+		} else {
+			index.Entries[chartName] = versions
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c.setCached(chartName, chartVersion, false)
+
+	return c.Client.RemoveObject(context.Background(), c.Bucket, c.objectName(fmt.Sprintf("%s-%s.tgz", chartName, chartVersion)), minio.RemoveObjectOptions{})
+}
+
+// updateIndex applies the update to index.yaml with optimistic locking. The index is written only if
+// it hasn't been changed since it was read, otherwise it's read again and the update is retried,
+// so concurrent helm-cache instances don't overwrite charts added by each other.
+func (c *ObjectStorageClient) updateIndex(update func(index *repo.IndexFile) error) error {
+	for attempt := 1; attempt <= indexUpdateAttempts; attempt++ {
+		index, etag, err := c.getIndex()
+		if err != nil {
+			return err
+		}
+
+		if err := update(index); err != nil {
+			return err
+		}
+		index.SortEntries()
+		index.Generated = time.Now()
+
+		data, err := yaml.Marshal(index)
+		if err != nil {
+			return err
+		}
+
+		// The first index is written unconditionally, as If-None-Match: * can't be sent by the client.
+		// A chart lost by a concurrent first write is missing in the index and is uploaded again.
+		opts := minio.PutObjectOptions{ContentType: "application/x-yaml"}
+		if etag != "" {
+			opts.SetMatchETag(etag)
+		}
+
+		_, err = c.Client.PutObject(context.Background(), c.Bucket, c.objectName(indexFileName), bytes.NewReader(data), int64(len(data)), opts)
+		if err == nil {
+			return nil
+		}
+		if code := minio.ToErrorResponse(err).Code; code != "PreconditionFailed" && code != "ConditionalRequestConflict" {
+			return err
+		}
+
+		zap.L().Sugar().Infof("Index of %s bucket has been changed by another instance, retrying (attempt %d)", c.Bucket, attempt)
+		time.Sleep(time.Duration(rand.Intn(500*attempt)) * time.Millisecond)
+	}
+
+	return errors.New(fmt.Sprintf("Can't update index of %s bucket after %d attempts", c.Bucket, indexUpdateAttempts))
+}
+
+// getIndex reads index.yaml with its ETag. An empty index and ETag are returned if it doesn't exist yet.
+func (c *ObjectStorageClient) getIndex() (*repo.IndexFile, string, error) {
+	object, err := c.Client.GetObject(context.Background(), c.Bucket, c.objectName(indexFileName), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, "", err
+	}
+	defer object.Close()
+
+	info, err := object.Stat()
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return repo.NewIndexFile(), "", nil
+		}
+		return nil, "", err
+	}
+
+	data, err := ioutil.ReadAll(object)
+	if err != nil {
+		return nil, "", err
+	}
+
+	index := repo.NewIndexFile()
+	if err := yaml.Unmarshal(data, index); err != nil {
+		return nil, "", err
+	}
+	if index.Entries == nil {
+		index.Entries = make(map[string]repo.ChartVersions)
+	}
+
+	return index, info.ETag, nil
+}
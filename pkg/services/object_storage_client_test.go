@@ -0,0 +1,245 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"helm.sh/helm/v3/pkg/repo"
+	"sigs.k8s.io/yaml"
+)
+
+// testS3 is an in-memory S3 bucket which supports conditional writes with If-Match.
+type testS3 struct {
+	mutex   sync.Mutex
+	bucket  string
+	objects map[string][]byte
+	// beforeConditionalPut is called once before the next conditional write, e.g. to simulate
+	// another instance writing the same object first
+	beforeConditionalPut func()
+}
+
+func newTestS3(t *testing.T, bucket string) (*testS3, *httptest.Server) {
+	s := &testS3{bucket: bucket, objects: make(map[string][]byte)}
+	server := httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(server.Close)
+
+	return s, server
+}
+
+func (s *testS3) put(key string, data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.objects[key] = data
+}
+
+func (s *testS3) get(key string) []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.objects[key]
+}
+
+func testETag(data []byte) string {
+	return fmt.Sprintf("%x", md5.Sum(data))
+}
+
+func (s *testS3) handle(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+s.bucket), "/")
+	if key == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		data := s.get(key)
+		if data == nil {
+			writeTestS3Error(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", fmt.Sprintf("%q", testETag(data)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodPut:
+		data, err := readTestS3Body(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s.mutex.Lock()
+		if match := r.Header.Get("If-Match"); match != "" {
+			if s.beforeConditionalPut != nil {
+				before := s.beforeConditionalPut
+				s.beforeConditionalPut = nil
+				s.mutex.Unlock()
+				before()
+				s.mutex.Lock()
+			}
+			if current, ok := s.objects[key]; !ok || fmt.Sprintf("%q", testETag(current)) != match {
+				s.mutex.Unlock()
+				writeTestS3Error(w, r, http.StatusPreconditionFailed, "PreconditionFailed")
+				return
+			}
+		}
+		s.objects[key] = data
+		s.mutex.Unlock()
+
+		w.Header().Set("ETag", fmt.Sprintf("%q", testETag(data)))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		s.mutex.Lock()
+		delete(s.objects, key)
+		s.mutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeTestS3Error(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+	}
+}
+
+// readTestS3Body reads the request body, decoding chunks of payloads signed with the streaming signature.
+func readTestS3Body(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+
+	var data []byte
+	reader := bufio.NewReader(r.Body)
+	for {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(header), ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func newTestObjectStorageClient(t *testing.T) (*ObjectStorageClient, *testS3) {
+	s, server := newTestS3(t, "charts")
+	c, err := NewObjectStorageClient(strings.TrimPrefix(server.URL, "http://"), "charts", "", "us-east-1", "access", "secret", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c, s
+}
+
+func readTestIndex(t *testing.T, s *testS3) *repo.IndexFile {
+	index := repo.NewIndexFile()
+	if err := yaml.Unmarshal(s.get(indexFileName), index); err != nil {
+		t.Fatal(err)
+	}
+
+	return index
+}
+
+func writeTestIndex(t *testing.T, s *testS3, index *repo.IndexFile) {
+	data, err := yaml.Marshal(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.put(indexFileName, data)
+}
+
+func readTestPackage(t *testing.T, name string, version string) []byte {
+	directory := t.TempDir()
+	saveTestPackage(t, newTestChart(name, version), directory)
+
+	data, err := os.ReadFile(filepath.Join(directory, fmt.Sprintf("%s-%s.tgz", name, version)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestObjectStorageClientKeepsChartsOfConcurrentWriters(t *testing.T) {
+	c, s := newTestObjectStorageClient(t)
+
+	if err := c.Put("first", "1.0.0", bytes.NewReader(readTestPackage(t, "first", "1.0.0"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another instance adds its chart between reading and writing of the index
+	s.beforeConditionalPut = func() {
+		index := readTestIndex(t, s)
+		index.Add(newTestChart("other", "2.0.0").Metadata, "other-2.0.0.tgz", "", "sha256:other")
+		writeTestIndex(t, s, index)
+	}
+
+	if err := c.Put("second", "1.0.0", bytes.NewReader(readTestPackage(t, "second", "1.0.0"))); err != nil {
+		t.Fatal(err)
+	}
+	if s.beforeConditionalPut != nil {
+		t.Fatal("Index has been written without a conditional write")
+	}
+
+	index := readTestIndex(t, s)
+	for chartName, chartVersion := range map[string]string{"first": "1.0.0", "other": "2.0.0", "second": "1.0.0"} {
+		if !index.Has(chartName, chartVersion) {
+			t.Errorf("Chart %s-%s is missing in the index", chartName, chartVersion)
+		}
+	}
+}
+
+func TestObjectStorageClientExistsRereadsIndex(t *testing.T) {
+	c, s := newTestObjectStorageClient(t)
+
+	// Charts added by others are found on a miss
+	index := repo.NewIndexFile()
+	index.Add(newTestChart("other", "1.0.0").Metadata, "other-1.0.0.tgz", "", "sha256:other")
+	writeTestIndex(t, s, index)
+
+	exists, err := c.Exists("other", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Fatal("Chart added to the index by another instance isn't found")
+	}
+
+	// Charts deleted by others are noticed when the cached index is outdated
+	writeTestIndex(t, s, repo.NewIndexFile())
+	c.cacheTime = time.Now().Add(-indexCacheTTL)
+
+	exists, err = c.Exists("other", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("Chart deleted from the index by another instance is still found")
+	}
+}
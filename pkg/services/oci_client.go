@@ -0,0 +1,236 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/turboazot/helm-cache/pkg/entities"
+	"helm.sh/helm/v3/pkg/registry"
+
+	"go.uber.org/zap"
+)
+
+// ociTagsCacheTTL is how long tags of a repository are trusted, so tags deleted by others are noticed
+const ociTagsCacheTTL = time.Minute
+
+// OCIClient pushes packaged charts as OCI artifacts to repositories of OCI registries.
+type OCIClient struct {
+	RegistryClient    *registry.Client
+	Repositories      []string
+	ChartVersionCache map[string]bool
+	// tagsTime is when tags of a chart repository were listed
+	tagsTime map[string]time.Time
+	mutex    sync.Mutex
+}
+
+// NewOCIClient logs into the registries of the repositories if credentials are given. Otherwise
+// credentials are taken from the registry credentials file of the registry client.
+func NewOCIClient(registryClient *registry.Client, repositories []string, username string, password string, insecure bool) (*OCIClient, error) {
+	c := &OCIClient{
+		RegistryClient:    registryClient,
+		ChartVersionCache: make(map[string]bool),
+		tagsTime:          make(map[string]time.Time),
+	}
+
+	for _, repository := range repositories {
+		repository = strings.TrimSuffix(strings.TrimPrefix(repository, fmt.Sprintf("%s://", registry.OCIScheme)), "/")
+		if !isValidRepository(repository) {
+			return nil, errors.New(fmt.Sprintf("Invalid OCI repository: %s", repository))
+		}
+		c.Repositories = append(c.Repositories, repository)
+	}
+
+	if username == "" || password == "" {
+		return c, nil
+	}
+
+	hosts := make(map[string]bool)
+	for _, repository := range c.Repositories {
+		host := strings.SplitN(repository, "/", 2)[0]
+		if hosts[host] {
+			continue
+		}
+		hosts[host] = true
+
+		if err := registryClient.Login(host, registry.LoginOptBasicAuth(username, password), registry.LoginOptInsecure(insecure)); err != nil {
+			return nil, err
+		}
+		zap.L().Sugar().Infof("Successfully logged into %s OCI registry", host)
+	}
+
+	return c, nil
+}
+
+func (c *OCIClient) IsActive() bool {
+	return len(c.Repositories) != 0
+}
+
+func (c *OCIClient) Name() string {
+	return fmt.Sprintf("OCI repositories %s", strings.Join(c.Repositories, ", "))
+}
+
+// Exists reports whether the chart version has been pushed to all repositories.
+func (c *OCIClient) Exists(chartName string, chartVersion string) (bool, error) {
+	for _, repository := range c.Repositories {
+		exists, err := c.isExistsInRepository(repository, chartName, chartVersion)
+		if err != nil {
+			return false, err
+		}
+		if !exists {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// isExistsInRepository looks the chart version up in the cached tags of the repository. Tags are listed
+// again when the chart version is missing or the cached tags are outdated, as others push and delete them too.
+func (c *OCIClient) isExistsInRepository(repository string, chartName string, chartVersion string) (bool, error) {
+	ref := fmt.Sprintf("%s/%s", repository, chartName)
+	if c.isCached(ref, chartVersion) {
+		return true, nil
+	}
+
+	tags, err := c.RegistryClient.Tags(ref)
+	if err != nil {
+		// Registries answer with "name unknown" for repositories which haven't been pushed yet
+		if message := strings.ToLower(err.Error()); strings.Contains(message, "not found") || strings.Contains(message, "name unknown") {
+			c.setTags(ref, nil)
+			return false, nil
+		}
+		return false, err
+	}
+	c.setTags(ref, tags)
+
+	return c.isCached(ref, chartVersion), nil
+}
+
+// setTags replaces cached tags of the chart repository.
+func (c *OCIClient) setTags(ref string, tags []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for cached := range c.ChartVersionCache {
+		if strings.HasPrefix(cached, fmt.Sprintf("%s:", ref)) {
+			delete(c.ChartVersionCache, cached)
+		}
+	}
+	for _, tag := range tags {
+		c.ChartVersionCache[fmt.Sprintf("%s:%s", ref, tag)] = true
+	}
+	c.tagsTime[ref] = time.Now()
+}
+
+func (c *OCIClient) setCached(ref string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.ChartVersionCache[ref] = true
+}
+
+// isCached reports whether the tag is cached and tags of the chart repository are still fresh.
+func (c *OCIClient) isCached(ref string, tag string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.ChartVersionCache[fmt.Sprintf("%s:%s", ref, tag)] && time.Since(c.tagsTime[ref]) < ociTagsCacheTTL
+}
+
+// Put pushes the packaged chart to every repository it's missing in.
+func (c *OCIClient) Put(chartName string, chartVersion string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	for _, repository := range c.Repositories {
+		exists, err := c.isExistsInRepository(repository, chartName, chartVersion)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		ref := fmt.Sprintf("%s/%s:%s", repository, chartName, chartVersion)
+		result, err := c.RegistryClient.Push(data, ref)
+		if err != nil {
+			return err
+		}
+
+		c.setCached(ref)
+
+		zap.L().Sugar().Infof("Successfully pushed chart %s with %s digest", result.Ref, result.Manifest.Digest)
+	}
+
+	return nil
+}
+
+// Get pulls the packaged chart from the first repository it exists in.
+func (c *OCIClient) Get(chartName string, chartVersion string) (io.ReadCloser, error) {
+	for _, repository := range c.Repositories {
+		exists, err := c.isExistsInRepository(repository, chartName, chartVersion)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+
+		result, err := c.RegistryClient.Pull(fmt.Sprintf("%s/%s:%s", repository, chartName, chartVersion))
+		if err != nil {
+			return nil, err
+		}
+
+		return ioutil.NopCloser(bytes.NewReader(result.Chart.Data)), nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("Chart %s-%s doesn't exist in OCI repositories", chartName, chartVersion))
+}
+
+// List returns chart versions pushed by this instance or seen in the repositories. OCI registries
+// can't list their repositories without the catalog API, which most of them don't expose.
+func (c *OCIClient) List() ([]entities.StoredChart, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	versions := make(map[string]bool)
+	var charts []entities.StoredChart
+
+	for ref, exists := range c.ChartVersionCache {
+		if !exists {
+			continue
+		}
+
+		index := strings.LastIndex(ref, ":")
+		chartName := ref[strings.LastIndex(ref[:index], "/")+1 : index]
+		chartVersion := ref[index+1:]
+		if versions[fmt.Sprintf("%s-%s", chartName, chartVersion)] {
+			continue
+		}
+		versions[fmt.Sprintf("%s-%s", chartName, chartVersion)] = true
+
+		charts = append(charts, entities.StoredChart{Name: chartName, Version: chartVersion})
+	}
+
+	return charts, nil
+}
+
+// Delete isn't supported as the Helm registry client can't delete manifests.
+func (c *OCIClient) Delete(chartName string, chartVersion string) error {
+	return errors.New("Deleting charts from OCI registries isn't supported")
+}
+
+// isValidRepository reports whether the repository is a reference without tag, e.g. ghcr.io/org/charts.
+func isValidRepository(repository string) bool {
+	u, err := url.Parse(fmt.Sprintf("%s://%s", registry.OCIScheme, repository))
+	return err == nil && u.Host != "" && !strings.Contains(u.Path, ":")
+}
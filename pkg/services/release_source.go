@@ -0,0 +1,284 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/turboazot/helm-cache/pkg/entities"
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	SecretDriver    = "secret"
+	ConfigMapDriver = "configmap"
+
+	helmReleaseLabelSelector = "owner=helm"
+	helmReleaseObjectPrefix  = "sh.helm.release.v1"
+	listPageSize             = 500
+)
+
+// ReleaseSource discovers Helm releases kept by one of the Helm storage drivers.
+type ReleaseSource interface {
+	// Cluster returns the name of the cluster this source reads releases from.
+	Cluster() string
+	// Driver returns the name of the Helm storage driver this source reads.
+	Driver() string
+	// ListRevisions returns all stored release revisions without their payload.
+	ListRevisions() ([]*entities.HelmReleaseRevision, error)
+	// GetRelease fetches and decodes the release stored for the revision.
+	GetRelease(rev *entities.HelmReleaseRevision) (*entities.HelmRelease, error)
+}
+
+// WatchableReleaseSource is a release source that is able to notify about changed releases.
+type WatchableReleaseSource interface {
+	ReleaseSource
+	// Watch calls handler with all stored revisions of a release whenever one of them is added
+	// or updated, and replays every release each resyncInterval. It blocks until stopCh is closed.
+	Watch(resyncInterval time.Duration, handler func([]*entities.HelmReleaseRevision), stopCh <-chan struct{}) error
+}
+
+// KubernetesReleaseSource reads releases stored in secrets or configmaps by the Helm v3 storage drivers.
+type KubernetesReleaseSource struct {
+	ClusterName         string
+	HelmClient          *HelmClient
+	KubernetesClientset kubernetes.Interface
+	MetadataClient      metadata.Interface
+	StorageDriver       string
+	Resource            schema.GroupVersionResource
+	NamespaceFilter     *entities.NamespaceFilter
+}
+
+func NewSecretReleaseSource(clusterName string, helmClient *HelmClient, clientset kubernetes.Interface, metadataClient metadata.Interface, namespaceFilter *entities.NamespaceFilter) *KubernetesReleaseSource {
+	return &KubernetesReleaseSource{
+		ClusterName:         clusterName,
+		HelmClient:          helmClient,
+		KubernetesClientset: clientset,
+		MetadataClient:      metadataClient,
+		StorageDriver:       SecretDriver,
+		Resource:            v1.SchemeGroupVersion.WithResource("secrets"),
+		NamespaceFilter:     namespaceFilter,
+	}
+}
+
+func NewConfigMapReleaseSource(clusterName string, helmClient *HelmClient, clientset kubernetes.Interface, metadataClient metadata.Interface, namespaceFilter *entities.NamespaceFilter) *KubernetesReleaseSource {
+	return &KubernetesReleaseSource{
+		ClusterName:         clusterName,
+		HelmClient:          helmClient,
+		KubernetesClientset: clientset,
+		MetadataClient:      metadataClient,
+		StorageDriver:       ConfigMapDriver,
+		Resource:            v1.SchemeGroupVersion.WithResource("configmaps"),
+		NamespaceFilter:     namespaceFilter,
+	}
+}
+
+func (s *KubernetesReleaseSource) Cluster() string {
+	return s.ClusterName
+}
+
+func (s *KubernetesReleaseSource) Driver() string {
+	return s.StorageDriver
+}
+
+// ListRevisions lists metadata of all helm release objects page by page.
+func (s *KubernetesReleaseSource) ListRevisions() ([]*entities.HelmReleaseRevision, error) {
+	var revisions []*entities.HelmReleaseRevision
+
+	for _, namespace := range s.NamespaceFilter.ScopedNamespaces() {
+		listOptions := metav1.ListOptions{
+			LabelSelector: helmReleaseLabelSelector,
+			Limit:         listPageSize,
+		}
+		for {
+			list, err := s.MetadataClient.Resource(s.Resource).Namespace(namespace).List(context.TODO(), listOptions)
+			if err != nil {
+				return nil, err
+			}
+
+			for index := range list.Items {
+				rev, err := s.newRevision(&list.Items[index])
+				if err != nil {
+					return nil, err
+				}
+				if rev != nil {
+					revisions = append(revisions, rev)
+				}
+			}
+
+			if list.Continue == "" {
+				break
+			}
+			listOptions.Continue = list.Continue
+		}
+	}
+
+	return revisions, nil
+}
+
+func (s *KubernetesReleaseSource) GetRelease(rev *entities.HelmReleaseRevision) (*entities.HelmRelease, error) {
+	var data string
+
+	switch s.StorageDriver {
+	case SecretDriver:
+		secret, err := s.KubernetesClientset.CoreV1().Secrets(rev.Namespace).Get(context.TODO(), rev.ObjectName, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		releaseData, releaseKeyExists := secret.Data["release"]
+		if !releaseKeyExists {
+			return nil, errors.New(fmt.Sprintf("Release secret %s doesn't contain release key in data", rev.ObjectName))
+		}
+		data = string(releaseData)
+	case ConfigMapDriver:
+		configMap, err := s.KubernetesClientset.CoreV1().ConfigMaps(rev.Namespace).Get(context.TODO(), rev.ObjectName, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		releaseData, releaseKeyExists := configMap.Data["release"]
+		if !releaseKeyExists {
+			return nil, errors.New(fmt.Sprintf("Release configmap %s doesn't contain release key in data", rev.ObjectName))
+		}
+		data = releaseData
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown storage driver %s", s.StorageDriver))
+	}
+
+	return s.HelmClient.DecodeRelease(data)
+}
+
+// watchedRelease is a release queued to be handled, informer is the index of the informer caching it.
+type watchedRelease struct {
+	informer    int
+	namespace   string
+	releaseName string
+}
+
+// Watch queues the release of every added or updated object. Events of objects of the same release
+// are merged while the release is queued, so the initial sync and resyncs hand each release to the
+// handler once instead of once per stored revision.
+func (s *KubernetesReleaseSource) Watch(resyncInterval time.Duration, handler func([]*entities.HelmReleaseRevision), stopCh <-chan struct{}) error {
+	var factories []metadatainformer.SharedInformerFactory
+	var listers []cache.GenericLister
+	queue := workqueue.New()
+	defer queue.ShutDown()
+
+	for index, namespace := range s.NamespaceFilter.ScopedNamespaces() {
+		factory := metadatainformer.NewFilteredSharedInformerFactory(s.MetadataClient, resyncInterval, namespace, func(options *metav1.ListOptions) {
+			options.LabelSelector = helmReleaseLabelSelector
+		})
+		informer := factory.ForResource(s.Resource)
+		listers = append(listers, informer.Lister())
+
+		handleObject := func(index int) func(obj interface{}) {
+			return func(obj interface{}) {
+				m, ok := obj.(*metav1.PartialObjectMetadata)
+				if !ok {
+					return
+				}
+
+				rev, err := s.newRevision(m)
+				if err != nil {
+					zap.L().Sugar().Infof("Can't get release revision of %s %s/%s in %s cluster: %v", s.StorageDriver, m.Namespace, m.Name, s.ClusterName, err)
+					return
+				}
+				if rev == nil {
+					return
+				}
+
+				queue.Add(watchedRelease{informer: index, namespace: rev.Namespace, releaseName: rev.ReleaseName})
+			}
+		}(index)
+
+		informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: handleObject,
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				handleObject(newObj)
+			},
+		})
+
+		factories = append(factories, factory)
+	}
+
+	for _, factory := range factories {
+		factory.Start(stopCh)
+		for informerType, synced := range factory.WaitForCacheSync(stopCh) {
+			if !synced {
+				return errors.New(fmt.Sprintf("Fail to sync informer cache for %v", informerType))
+			}
+		}
+	}
+	zap.L().Sugar().Infof("Helm release %s informers of %s cluster are synced, watching for changes...", s.StorageDriver, s.ClusterName)
+
+	go func() {
+		for {
+			item, shutdown := queue.Get()
+			if shutdown {
+				return
+			}
+			release := item.(watchedRelease)
+
+			revisions, err := s.getReleaseRevisions(listers[release.informer], release.namespace, release.releaseName)
+			if err != nil {
+				zap.L().Sugar().Infof("Can't get release revisions of %s/%s %s release in %s cluster: %v", release.namespace, release.releaseName, s.StorageDriver, s.ClusterName, err)
+			} else if len(revisions) > 0 {
+				handler(revisions)
+			}
+
+			queue.Done(item)
+		}
+	}()
+
+	<-stopCh
+
+	return nil
+}
+
+// getReleaseRevisions returns all revisions of the release from the informer cache.
+func (s *KubernetesReleaseSource) getReleaseRevisions(lister cache.GenericLister, namespace string, releaseName string) ([]*entities.HelmReleaseRevision, error) {
+	selector, err := labels.Parse(fmt.Sprintf("%s,name=%s", helmReleaseLabelSelector, releaseName))
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := lister.ByNamespace(namespace).List(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	var revisions []*entities.HelmReleaseRevision
+	for _, obj := range objects {
+		om, ok := obj.(*metav1.PartialObjectMetadata)
+		if !ok {
+			continue
+		}
+		r, err := s.newRevision(om)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			revisions = append(revisions, r)
+		}
+	}
+
+	return revisions, nil
+}
+
+func (s *KubernetesReleaseSource) newRevision(m *metav1.PartialObjectMetadata) (*entities.HelmReleaseRevision, error) {
+	if !strings.HasPrefix(m.Name, helmReleaseObjectPrefix) || !s.NamespaceFilter.Matches(m.Namespace) {
+		return nil, nil
+	}
+
+	return entities.NewHelmReleaseRevision(s.ClusterName, s.StorageDriver, m)
+}
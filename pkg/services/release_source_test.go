@@ -0,0 +1,101 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/turboazot/helm-cache/pkg/entities"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	metadatafake "k8s.io/client-go/metadata/fake"
+)
+
+func newTestReleaseObject(releaseName string, revision int, status string) *metav1.PartialObjectMetadata {
+	return &metav1.PartialObjectMetadata{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      fmt.Sprintf("sh.helm.release.v1.%s.v%d", releaseName, revision),
+			Labels: map[string]string{
+				"owner":   "helm",
+				"name":    releaseName,
+				"version": fmt.Sprint(revision),
+				"status":  status,
+			},
+		},
+	}
+}
+
+// waitForRevisions returns names and sorted revisions of the release handed to the handler.
+func waitForRevisions(t *testing.T, handled <-chan []*entities.HelmReleaseRevision) (string, []int) {
+	select {
+	case revisions := <-handled:
+		var numbers []int
+		for _, rev := range revisions {
+			numbers = append(numbers, rev.Revision)
+		}
+		sort.Ints(numbers)
+		return revisions[0].ReleaseName, numbers
+	case <-time.After(5 * time.Second):
+		t.Fatal("Release revisions haven't been handled")
+		return "", nil
+	}
+}
+
+func TestKubernetesReleaseSourceWatch(t *testing.T) {
+	scheme := metadatafake.NewTestScheme()
+	if err := metav1.AddMetaToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	metadataClient := metadatafake.NewSimpleMetadataClient(scheme,
+		newTestReleaseObject("app", 1, "superseded"),
+		newTestReleaseObject("app", 2, "deployed"),
+		newTestReleaseObject("other", 1, "deployed"),
+	)
+	source := NewSecretReleaseSource("test", nil, nil, metadataClient, entities.NewNamespaceFilter(nil, nil))
+
+	handled := make(chan []*entities.HelmReleaseRevision, 10)
+	stopCh := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- source.Watch(time.Hour, func(revisions []*entities.HelmReleaseRevision) {
+			handled <- revisions
+		}, stopCh)
+	}()
+	defer func() {
+		close(stopCh)
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// The initial sync hands every release to the handler once with all of its revisions
+	releases := make(map[string][]int)
+	for i := 0; i < 2; i++ {
+		releaseName, revisions := waitForRevisions(t, handled)
+		if _, ok := releases[releaseName]; ok {
+			t.Fatalf("Release %s has been handled more than once", releaseName)
+		}
+		releases[releaseName] = revisions
+	}
+	if fmt.Sprint(releases["app"]) != "[1 2]" || fmt.Sprint(releases["other"]) != "[1]" {
+		t.Fatalf("Unexpected revisions of releases %v", releases)
+	}
+	select {
+	case revisions := <-handled:
+		t.Fatalf("Release %s has been handled more than once", revisions[0].ReleaseName)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// A new revision hands all revisions of its release to the handler
+	client := metadataClient.Resource(v1.SchemeGroupVersion.WithResource("secrets")).Namespace("default").(metadatafake.MetadataClient)
+	if _, err := client.CreateFake(newTestReleaseObject("app", 3, "deployed"), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	releaseName, revisions := waitForRevisions(t, handled)
+	if releaseName != "app" || fmt.Sprint(revisions) != "[1 2 3]" {
+		t.Fatalf("Expected all revisions of app release, got %s %v", releaseName, revisions)
+	}
+}
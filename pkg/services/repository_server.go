@@ -0,0 +1,101 @@
+package services
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"helm.sh/helm/v3/pkg/repo"
+	"sigs.k8s.io/yaml"
+
+	"go.uber.org/zap"
+)
+
+// RepositoryServer serves packaged charts of the local cache as a Helm repository.
+type RepositoryServer struct {
+	Directory string
+	Address   string
+
+	mutex        sync.Mutex
+	index        []byte
+	indexModTime time.Time
+}
+
+func NewRepositoryServer(directory string, address string) *RepositoryServer {
+	return &RepositoryServer{
+		Directory: directory,
+		Address:   address,
+	}
+}
+
+func (s *RepositoryServer) IsActive() bool {
+	return s.Address != ""
+}
+
+// ListenAndServe serves index.yaml and packaged charts until the server fails.
+func (s *RepositoryServer) ListenAndServe() error {
+	zap.L().Sugar().Infof("Serving helm repository on %s", s.Address)
+
+	return http.ListenAndServe(s.Address, s)
+}
+
+func (s *RepositoryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+	switch {
+	case name == "" || name == indexFileName:
+		index, err := s.getIndex()
+		if err != nil {
+			zap.L().Sugar().Infof("Can't generate index of %s: %v", s.Directory, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-yaml")
+		w.Write(index)
+	case strings.HasSuffix(name, ".tgz") && !strings.Contains(name, "/"):
+		w.Header().Set("Content-Type", "application/gzip")
+		http.ServeFile(w, r, filepath.Join(s.Directory, name))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// getIndex generates index.yaml of the packaged charts. The index is generated again only when
+// the directory has been changed, as loading every chart is expensive.
+func (s *RepositoryServer) getIndex() ([]byte, error) {
+	fi, err := os.Stat(s.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.index != nil && fi.ModTime().Equal(s.indexModTime) {
+		return s.index, nil
+	}
+
+	index, err := repo.IndexDirectory(s.Directory, "")
+	if err != nil {
+		return nil, err
+	}
+	index.SortEntries()
+
+	data, err := yaml.Marshal(index)
+	if err != nil {
+		return nil, err
+	}
+
+	s.index = data
+	s.indexModTime = fi.ModTime()
+
+	return data, nil
+}
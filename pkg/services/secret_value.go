@@ -0,0 +1,101 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// secretValueRefreshInterval is an interval between reading values of Kubernetes secrets again
+const secretValueRefreshInterval = time.Minute
+
+// SecretValue is a credential given inline, in a file or in a key of a Kubernetes secret. Files are
+// read on every use and secrets every secretValueRefreshInterval, so rotated credentials are picked up
+// without a restart.
+type SecretValue struct {
+	Value      string
+	File       string
+	SecretRef  string
+	Clientset  kubernetes.Interface
+	mutex      sync.Mutex
+	cached     string
+	cachedTime time.Time
+}
+
+// NewSecretValue creates a credential from one of its sources. secretRef is a reference to a key of
+// a Kubernetes secret in namespace/name/key format.
+func NewSecretValue(value string, file string, secretRef string, clientset kubernetes.Interface) (*SecretValue, error) {
+	if secretRef != "" {
+		if len(strings.Split(secretRef, "/")) != 3 {
+			return nil, errors.New(fmt.Sprintf("Invalid secret reference %s, namespace/name/key is expected", secretRef))
+		}
+		if clientset == nil {
+			return nil, errors.New(fmt.Sprintf("Kubernetes client is required to read %s secret", secretRef))
+		}
+	}
+
+	return &SecretValue{
+		Value:     value,
+		File:      file,
+		SecretRef: secretRef,
+		Clientset: clientset,
+	}, nil
+}
+
+func (v *SecretValue) IsSet() bool {
+	return v != nil && (v.Value != "" || v.File != "" || v.SecretRef != "")
+}
+
+// Get returns the current value of the credential. A secret which can't be read again keeps its
+// last known value, so a temporary API server outage doesn't break authentication.
+func (v *SecretValue) Get() (string, error) {
+	switch {
+	case v == nil:
+		return "", nil
+	case v.File != "":
+		data, err := os.ReadFile(v.File)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	case v.SecretRef != "":
+		return v.getSecret()
+	default:
+		return v.Value, nil
+	}
+}
+
+func (v *SecretValue) getSecret() (string, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if !v.cachedTime.IsZero() && time.Since(v.cachedTime) < secretValueRefreshInterval {
+		return v.cached, nil
+	}
+
+	ref := strings.Split(v.SecretRef, "/")
+	secret, err := v.Clientset.CoreV1().Secrets(ref[0]).Get(context.Background(), ref[1], metav1.GetOptions{})
+	if err != nil {
+		if !v.cachedTime.IsZero() {
+			return v.cached, nil
+		}
+		return "", err
+	}
+
+	data, ok := secret.Data[ref[2]]
+	if !ok {
+		return "", errors.New(fmt.Sprintf("Secret %s/%s doesn't have %s key", ref[0], ref[1], ref[2]))
+	}
+
+	v.cached = strings.TrimSpace(string(data))
+	v.cachedTime = time.Now()
+
+	return v.cached, nil
+}
@@ -0,0 +1,91 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSecretValueFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := NewSecretValue("", path, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := v.Get(); err != nil || value != "first" {
+		t.Fatalf("Expected first value, got %q (%v)", value, err)
+	}
+
+	// Files are read on every use, so rotated credentials are picked up at once
+	if err := os.WriteFile(path, []byte("second\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := v.Get(); err != nil || value != "second" {
+		t.Fatalf("Expected rotated value, got %q (%v)", value, err)
+	}
+}
+
+func TestSecretValueKeepsLastValueWhenSecretCantBeRead(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "helm-cache", Name: "chartmuseum"},
+		Data:       map[string][]byte{"token": []byte("first")},
+	})
+
+	v, err := NewSecretValue("", "", "helm-cache/chartmuseum/token", clientset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := v.Get(); err != nil || value != "first" {
+		t.Fatalf("Expected first value, got %q (%v)", value, err)
+	}
+
+	// Rotated secrets are read again after the refresh interval
+	secret, err := clientset.CoreV1().Secrets("helm-cache").Get(context.Background(), "chartmuseum", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret.Data["token"] = []byte("second")
+	if _, err := clientset.CoreV1().Secrets("helm-cache").Update(context.Background(), secret, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := v.Get(); value != "first" {
+		t.Fatalf("Expected cached value before the refresh interval, got %q", value)
+	}
+	v.cachedTime = time.Now().Add(-secretValueRefreshInterval)
+	if value, err := v.Get(); err != nil || value != "second" {
+		t.Fatalf("Expected rotated value, got %q (%v)", value, err)
+	}
+
+	// A secret which can't be read keeps its last known value
+	if err := clientset.CoreV1().Secrets("helm-cache").Delete(context.Background(), "chartmuseum", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	v.cachedTime = time.Now().Add(-secretValueRefreshInterval)
+	if value, err := v.Get(); err != nil || value != "second" {
+		t.Fatalf("Expected last known value, got %q (%v)", value, err)
+	}
+}
+
+func TestSecretValueFailsWithoutSecret(t *testing.T) {
+	v, err := NewSecretValue("", "", "helm-cache/chartmuseum/token", fake.NewSimpleClientset())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Get(); err == nil {
+		t.Fatal("Expected an error for a missing secret without a known value")
+	}
+
+	if _, err := NewSecretValue("", "", "chartmuseum/token", fake.NewSimpleClientset()); err == nil {
+		t.Fatal("Expected an error for an invalid secret reference")
+	}
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"database/sql"
+
+	"github.com/turboazot/helm-cache/pkg/entities"
+
+	// Import pq for postgres dialect
+	_ "github.com/lib/pq"
+)
+
+const (
+	SQLDriver = "sql"
+
+	postgreSQLDialect = "postgres"
+)
+
+// SQLReleaseSource reads releases stored in the releases_v1 table by the Helm SQL storage driver.
+type SQLReleaseSource struct {
+	HelmClient      *HelmClient
+	DB              *sql.DB
+	NamespaceFilter *entities.NamespaceFilter
+}
+
+func NewSQLReleaseSource(helmClient *HelmClient, connectionString string, namespaceFilter *entities.NamespaceFilter) (*SQLReleaseSource, error) {
+	db, err := sql.Open(postgreSQLDialect, connectionString)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return NewSQLReleaseSourceFromDB(helmClient, db, namespaceFilter), nil
+}
+
+// NewSQLReleaseSourceFromDB creates a source reading releases from an already opened database.
+func NewSQLReleaseSourceFromDB(helmClient *HelmClient, db *sql.DB, namespaceFilter *entities.NamespaceFilter) *SQLReleaseSource {
+	return &SQLReleaseSource{
+		HelmClient:      helmClient,
+		DB:              db,
+		NamespaceFilter: namespaceFilter,
+	}
+}
+
+func (s *SQLReleaseSource) Cluster() string {
+	return ""
+}
+
+func (s *SQLReleaseSource) Driver() string {
+	return SQLDriver
+}
+
+// ListRevisions selects release revisions without their body.
+func (s *SQLReleaseSource) ListRevisions() ([]*entities.HelmReleaseRevision, error) {
+	rows, err := s.DB.Query("SELECT key, namespace, name, version, status FROM releases_v1 WHERE owner = $1", "helm")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []*entities.HelmReleaseRevision
+	for rows.Next() {
+		rev := &entities.HelmReleaseRevision{Driver: SQLDriver}
+		if err := rows.Scan(&rev.ObjectName, &rev.Namespace, &rev.ReleaseName, &rev.Revision, &rev.Status); err != nil {
+			return nil, err
+		}
+		if s.NamespaceFilter.Matches(rev.Namespace) {
+			revisions = append(revisions, rev)
+		}
+	}
+
+	return revisions, rows.Err()
+}
+
+func (s *SQLReleaseSource) GetRelease(rev *entities.HelmReleaseRevision) (*entities.HelmRelease, error) {
+	var body string
+
+	err := s.DB.QueryRow("SELECT body FROM releases_v1 WHERE key = $1 AND namespace = $2", rev.ObjectName, rev.Namespace).Scan(&body)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.HelmClient.DecodeRelease(body)
+}
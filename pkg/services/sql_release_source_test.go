@@ -0,0 +1,88 @@
+package services
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/turboazot/helm-cache/pkg/entities"
+	"helm.sh/helm/v3/pkg/release"
+)
+
+// encodeRelease encodes the release the way Helm storage drivers do.
+func encodeRelease(t *testing.T, rel *release.Release) string {
+	data, err := json.Marshal(rel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return compressRelease(t, data)
+}
+
+func newTestSQLReleaseSource(t *testing.T, namespaceFilter *entities.NamespaceFilter) (*SQLReleaseSource, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	return NewSQLReleaseSourceFromDB(newTestHelmClient(t), db, namespaceFilter), mock
+}
+
+func TestSQLReleaseSourceListRevisions(t *testing.T) {
+	s, mock := newTestSQLReleaseSource(t, entities.NewNamespaceFilter(nil, []string{"*-sandbox"}))
+
+	mock.ExpectQuery("SELECT key, namespace, name, version, status FROM releases_v1 WHERE owner = \\$1").
+		WithArgs("helm").
+		WillReturnRows(sqlmock.NewRows([]string{"key", "namespace", "name", "version", "status"}).
+			AddRow("sh.helm.release.v1.app.v1", "default", "app", 1, "superseded").
+			AddRow("sh.helm.release.v1.app.v2", "default", "app", 2, "deployed").
+			AddRow("sh.helm.release.v1.test.v1", "team-sandbox", "test", 1, "deployed"))
+
+	revisions, err := s.ListRevisions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*entities.HelmReleaseRevision{
+		{Driver: SQLDriver, Namespace: "default", ReleaseName: "app", Revision: 1, Status: "superseded", ObjectName: "sh.helm.release.v1.app.v1"},
+		{Driver: SQLDriver, Namespace: "default", ReleaseName: "app", Revision: 2, Status: "deployed", ObjectName: "sh.helm.release.v1.app.v2"},
+	}
+	if !reflect.DeepEqual(revisions, expected) {
+		t.Errorf("Unexpected revisions %+v", revisions)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSQLReleaseSourceGetRelease(t *testing.T) {
+	s, mock := newTestSQLReleaseSource(t, entities.NewNamespaceFilter(nil, nil))
+
+	body := encodeRelease(t, &release.Release{
+		Name:      "app",
+		Namespace: "default",
+		Version:   2,
+		Info:      &release.Info{Status: release.StatusDeployed},
+		Chart:     newTestChart("app", "1.0.0"),
+	})
+	mock.ExpectQuery("SELECT body FROM releases_v1 WHERE key = \\$1 AND namespace = \\$2").
+		WithArgs("sh.helm.release.v1.app.v2", "default").
+		WillReturnRows(sqlmock.NewRows([]string{"body"}).AddRow(body))
+
+	r, err := s.GetRelease(&entities.HelmReleaseRevision{Driver: SQLDriver, Namespace: "default", ReleaseName: "app", Revision: 2, ObjectName: "sh.helm.release.v1.app.v2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Release.Name != "app" || r.Release.Version != 2 || r.Release.Chart.Metadata.Name != "app" || r.Release.Chart.Metadata.Version != "1.0.0" {
+		t.Errorf("Unexpected release %s/%s of %s-%s chart", r.Release.Namespace, r.Release.Name, r.Release.Chart.Metadata.Name, r.Release.Chart.Metadata.Version)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
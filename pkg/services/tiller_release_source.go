@@ -0,0 +1,262 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/turboazot/helm-cache/pkg/entities"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+	hapichart "k8s.io/helm/pkg/proto/hapi/chart"
+	hapirelease "k8s.io/helm/pkg/proto/hapi/release"
+)
+
+const (
+	TillerDriver = "tiller"
+
+	tillerNamespace            = "kube-system"
+	tillerReleaseLabelSelector = "OWNER=TILLER"
+)
+
+// ErrExcludedRelease is returned for Tiller releases installed to namespaces excluded by the namespace filter
+var ErrExcludedRelease = errors.New("Release is installed to an excluded namespace")
+
+// tillerStatuses maps Helm v2 release status codes to Helm v3 release statuses.
+var tillerStatuses = map[string]release.Status{
+	hapirelease.Status_UNKNOWN.String():          release.StatusUnknown,
+	hapirelease.Status_DEPLOYED.String():         release.StatusDeployed,
+	hapirelease.Status_DELETED.String():          release.StatusUninstalled,
+	hapirelease.Status_SUPERSEDED.String():       release.StatusSuperseded,
+	hapirelease.Status_FAILED.String():           release.StatusFailed,
+	hapirelease.Status_DELETING.String():         release.StatusUninstalling,
+	hapirelease.Status_PENDING_INSTALL.String():  release.StatusPendingInstall,
+	hapirelease.Status_PENDING_UPGRADE.String():  release.StatusPendingUpgrade,
+	hapirelease.Status_PENDING_ROLLBACK.String(): release.StatusPendingRollback,
+}
+
+// TillerReleaseSource reads releases stored in kube-system configmaps by Tiller, the Helm v2 server,
+// and converts them to Helm v3 releases.
+type TillerReleaseSource struct {
+	ClusterName         string
+	HelmClient          *HelmClient
+	KubernetesClientset kubernetes.Interface
+	MetadataClient      metadata.Interface
+	NamespaceFilter     *entities.NamespaceFilter
+}
+
+func NewTillerReleaseSource(clusterName string, helmClient *HelmClient, clientset kubernetes.Interface, metadataClient metadata.Interface, namespaceFilter *entities.NamespaceFilter) *TillerReleaseSource {
+	return &TillerReleaseSource{
+		ClusterName:         clusterName,
+		HelmClient:          helmClient,
+		KubernetesClientset: clientset,
+		MetadataClient:      metadataClient,
+		NamespaceFilter:     namespaceFilter,
+	}
+}
+
+func (s *TillerReleaseSource) Cluster() string {
+	return s.ClusterName
+}
+
+func (s *TillerReleaseSource) Driver() string {
+	return TillerDriver
+}
+
+// ListRevisions lists metadata of all Tiller release configmaps page by page.
+func (s *TillerReleaseSource) ListRevisions() ([]*entities.HelmReleaseRevision, error) {
+	var revisions []*entities.HelmReleaseRevision
+
+	listOptions := metav1.ListOptions{
+		LabelSelector: tillerReleaseLabelSelector,
+		Limit:         listPageSize,
+	}
+	for {
+		list, err := s.MetadataClient.Resource(v1.SchemeGroupVersion.WithResource("configmaps")).Namespace(tillerNamespace).List(context.TODO(), listOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		for index := range list.Items {
+			rev, err := s.newRevision(&list.Items[index])
+			if err != nil {
+				return nil, err
+			}
+			revisions = append(revisions, rev)
+		}
+
+		if list.Continue == "" {
+			break
+		}
+		listOptions.Continue = list.Continue
+	}
+
+	return revisions, nil
+}
+
+// GetRelease reads and converts the Tiller release. All Tiller releases are kept in kube-system, the namespace
+// they're installed to is only known after decoding, so ErrExcludedRelease is returned for excluded namespaces.
+func (s *TillerReleaseSource) GetRelease(rev *entities.HelmReleaseRevision) (*entities.HelmRelease, error) {
+	configMap, err := s.KubernetesClientset.CoreV1().ConfigMaps(rev.Namespace).Get(context.TODO(), rev.ObjectName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	releaseData, releaseKeyExists := configMap.Data["release"]
+	if !releaseKeyExists {
+		return nil, errors.New(fmt.Sprintf("Tiller configmap %s doesn't contain release key in data", rev.ObjectName))
+	}
+
+	decodedBytes, err := decompressRelease(releaseData)
+	if err != nil {
+		return nil, err
+	}
+
+	var tillerRelease hapirelease.Release
+	if err := proto.Unmarshal(decodedBytes, &tillerRelease); err != nil {
+		return nil, err
+	}
+
+	rel, err := convertTillerRelease(&tillerRelease)
+	if err != nil {
+		return nil, err
+	}
+	if s.NamespaceFilter != nil && !s.NamespaceFilter.Matches(rel.Namespace) {
+		return nil, ErrExcludedRelease
+	}
+
+	return s.HelmClient.newHelmRelease(rel), nil
+}
+
+// newRevision creates a release revision from the NAME, VERSION and STATUS labels set by Tiller.
+func (s *TillerReleaseSource) newRevision(m *metav1.PartialObjectMetadata) (*entities.HelmReleaseRevision, error) {
+	revision, err := strconv.Atoi(m.Labels["VERSION"])
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Tiller configmap %s has invalid VERSION label: %v", m.Name, err))
+	}
+
+	return &entities.HelmReleaseRevision{
+		Cluster:     s.ClusterName,
+		Driver:      TillerDriver,
+		Namespace:   m.Namespace,
+		ReleaseName: m.Labels["NAME"],
+		Revision:    revision,
+		Status:      convertTillerStatus(m.Labels["STATUS"]).String(),
+		ObjectName:  m.Name,
+	}, nil
+}
+
+func convertTillerStatus(status string) release.Status {
+	if s, ok := tillerStatuses[strings.ToUpper(status)]; ok {
+		return s
+	}
+
+	return release.StatusUnknown
+}
+
+// convertTillerRelease converts a Helm v2 release to a Helm v3 one, keeping only the fields needed
+// to save and package its chart.
+func convertTillerRelease(tillerRelease *hapirelease.Release) (*release.Release, error) {
+	if tillerRelease.Chart == nil || tillerRelease.Chart.Metadata == nil {
+		return nil, errors.New(fmt.Sprintf("Tiller release %s doesn't contain chart", tillerRelease.Name))
+	}
+
+	c, err := convertTillerChart(tillerRelease.Chart)
+	if err != nil {
+		return nil, err
+	}
+
+	var config map[string]interface{}
+	if tillerRelease.Config != nil {
+		config, err = chartutil.ReadValues([]byte(tillerRelease.Config.Raw))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rel := &release.Release{
+		Name:      tillerRelease.Name,
+		Info:      &release.Info{Status: release.StatusUnknown},
+		Chart:     c,
+		Config:    config,
+		Manifest:  tillerRelease.Manifest,
+		Version:   int(tillerRelease.Version),
+		Namespace: tillerRelease.Namespace,
+	}
+	if tillerRelease.Info != nil {
+		rel.Info.Description = tillerRelease.Info.Description
+		if tillerRelease.Info.Status != nil {
+			rel.Info.Status = convertTillerStatus(tillerRelease.Info.Status.Code.String())
+			rel.Info.Notes = tillerRelease.Info.Status.Notes
+		}
+	}
+
+	return rel, nil
+}
+
+// convertTillerChart converts a Helm v2 chart along with its dependencies. Files like requirements.yaml
+// are kept as they are, so the chart stays a v1 chart which Helm v3 is still able to package.
+func convertTillerChart(tillerChart *hapichart.Chart) (*chart.Chart, error) {
+	m := tillerChart.Metadata
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{
+			Name:        m.Name,
+			Home:        m.Home,
+			Sources:     m.Sources,
+			Version:     m.Version,
+			Description: m.Description,
+			Keywords:    m.Keywords,
+			Icon:        m.Icon,
+			APIVersion:  m.ApiVersion,
+			Condition:   m.Condition,
+			Tags:        m.Tags,
+			AppVersion:  m.AppVersion,
+			Deprecated:  m.Deprecated,
+			Annotations: m.Annotations,
+			KubeVersion: m.KubeVersion,
+		},
+	}
+	if c.Metadata.APIVersion == "" {
+		c.Metadata.APIVersion = chart.APIVersionV1
+	}
+	for _, maintainer := range m.Maintainers {
+		c.Metadata.Maintainers = append(c.Metadata.Maintainers, &chart.Maintainer{
+			Name:  maintainer.Name,
+			Email: maintainer.Email,
+			URL:   maintainer.Url,
+		})
+	}
+
+	for _, t := range tillerChart.Templates {
+		c.Templates = append(c.Templates, &chart.File{Name: t.Name, Data: t.Data})
+	}
+	for _, f := range tillerChart.Files {
+		c.Files = append(c.Files, &chart.File{Name: f.TypeUrl, Data: f.Value})
+	}
+
+	if tillerChart.Values != nil {
+		values, err := chartutil.ReadValues([]byte(tillerChart.Values.Raw))
+		if err != nil {
+			return nil, err
+		}
+		c.Values = values
+		c.Raw = append(c.Raw, &chart.File{Name: chartutil.ValuesfileName, Data: []byte(tillerChart.Values.Raw)})
+	}
+
+	for _, tillerDependency := range tillerChart.Dependencies {
+		dependency, err := convertTillerChart(tillerDependency)
+		if err != nil {
+			return nil, err
+		}
+		c.AddDependency(dependency)
+	}
+
+	return c, nil
+}
@@ -0,0 +1,61 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/turboazot/helm-cache/pkg/entities"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	hapichart "k8s.io/helm/pkg/proto/hapi/chart"
+	hapirelease "k8s.io/helm/pkg/proto/hapi/release"
+)
+
+// newTillerConfigMap encodes the release the way Tiller stores it.
+func newTillerConfigMap(t *testing.T, name string, namespace string) *v1.ConfigMap {
+	data, err := proto.Marshal(&hapirelease.Release{
+		Name:      name,
+		Namespace: namespace,
+		Version:   1,
+		Info:      &hapirelease.Info{Status: &hapirelease.Status{Code: hapirelease.Status_DEPLOYED}},
+		Chart: &hapichart.Chart{
+			Metadata: &hapichart.Metadata{Name: "app", Version: "1.0.0"},
+			Values:   &hapichart.Config{Raw: "replicas: 1\n"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name + ".v1",
+			Namespace: tillerNamespace,
+			Labels:    map[string]string{"OWNER": "TILLER", "NAME": name, "VERSION": "1", "STATUS": "DEPLOYED"},
+		},
+		Data: map[string]string{"release": compressRelease(t, data)},
+	}
+}
+
+func TestTillerReleaseSourceNamespaceFilter(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		newTillerConfigMap(t, "app", "team-a"),
+		newTillerConfigMap(t, "test", "team-a-sandbox"),
+	)
+	s := NewTillerReleaseSource("local", newTestHelmClient(t), clientset, nil, entities.NewNamespaceFilter([]string{"kube-system", "team-*"}, []string{"*-sandbox"}))
+
+	r, err := s.GetRelease(&entities.HelmReleaseRevision{Cluster: "local", Driver: TillerDriver, Namespace: tillerNamespace, ReleaseName: "app", Revision: 1, ObjectName: "app.v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Release.Namespace != "team-a" || r.Release.Chart.Metadata.Name != "app" || r.Release.Chart.Metadata.APIVersion != "v1" {
+		t.Errorf("Unexpected release %s/%s of %s chart", r.Release.Namespace, r.Release.Name, r.Release.Chart.Metadata.Name)
+	}
+
+	_, err = s.GetRelease(&entities.HelmReleaseRevision{Cluster: "local", Driver: TillerDriver, Namespace: tillerNamespace, ReleaseName: "test", Revision: 1, ObjectName: "test.v1"})
+	if !errors.Is(err, ErrExcludedRelease) {
+		t.Errorf("Release of an excluded namespace is read: %v", err)
+	}
+}
@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 
@@ -31,6 +33,30 @@ func WriteStringToFile(path string, content string) error {
 	return nil
 }
 
+// WriteFileAtomically writes the file with write to a temporary file next to it first and renames it
+// afterwards, so a partially written file is never visible. The file is readable by everyone.
+func WriteFileAtomically(path string, write func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), fmt.Sprintf(".%s-*.tmp", filepath.Base(path)))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// Temporary files are only readable by the owner
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
 func WriteYamlToFile(in interface{}, path string) error {
 	d, err := yaml.Marshal(in)
 	if err != nil {
@@ -41,3 +67,12 @@ func WriteYamlToFile(in interface{}, path string) error {
 
 	return err
 }
+
+func ReadYamlFromFile(path string, out interface{}) error {
+	d, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return yaml.Unmarshal(d, out)
+}
@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomically(t *testing.T) {
+	directory := t.TempDir()
+	path := filepath.Join(directory, "chart-1.0.0.tgz")
+
+	err := WriteFileAtomically(path, func(w io.Writer) error {
+		_, err := w.Write([]byte("package"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Fatalf("expected file mode 0644, got %v", info.Mode().Perm())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "package" {
+		t.Fatalf("unexpected file contents %q", data)
+	}
+}
+
+func TestWriteFileAtomicallyKeepsFileOnFailure(t *testing.T) {
+	directory := t.TempDir()
+	path := filepath.Join(directory, "chart-1.0.0.tgz")
+	if err := os.WriteFile(path, []byte("package"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := WriteFileAtomically(path, func(w io.Writer) error {
+		if _, err := w.Write([]byte("partial")); err != nil {
+			return err
+		}
+		return errors.New("interrupted")
+	})
+	if err == nil {
+		t.Fatal("expected the write error to be returned")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "package" {
+		t.Fatalf("expected the previous file to be kept, got %q", data)
+	}
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected temporary files to be removed, got %d files", len(entries))
+	}
+}
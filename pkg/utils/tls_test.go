@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePEM(t *testing.T, blockType string, data []byte) string {
+	path := filepath.Join(t.TempDir(), "file.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// newClientCertificate creates a self-signed client certificate and returns it with paths of its files.
+func newClientCertificate(t *testing.T) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "helm-cache"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, writePEM(t, "CERTIFICATE", der), writePEM(t, "EC PRIVATE KEY", keyDer)
+}
+
+func getWithTLSConfig(server *httptest.Server, config *tls.Config) error {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return nil
+}
+
+func newTestTLSServer(t *testing.T) *httptest.Server {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestNewTLSConfigDefaults(t *testing.T) {
+	config, err := NewTLSConfig("", "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config != nil {
+		t.Error("TLS config is created without options")
+	}
+
+	if err := getWithTLSConfig(newTestTLSServer(t), config); err == nil {
+		t.Error("Certificate of an unknown CA is trusted")
+	}
+}
+
+func TestNewTLSConfigCustomCA(t *testing.T) {
+	server := newTestTLSServer(t)
+
+	config, err := NewTLSConfig(writePEM(t, "CERTIFICATE", server.Certificate().Raw), "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := getWithTLSConfig(server, config); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewTLSConfigInsecureSkipVerify(t *testing.T) {
+	config, err := NewTLSConfig("", "", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := getWithTLSConfig(newTestTLSServer(t), config); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewTLSConfigMutualTLS(t *testing.T) {
+	clientCert, certFile, keyFile := newClientCertificate(t)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	caFile := writePEM(t, "CERTIFICATE", server.Certificate().Raw)
+
+	config, err := NewTLSConfig(caFile, "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := getWithTLSConfig(server, config); err == nil {
+		t.Error("Server requiring a client certificate is accessed without it")
+	}
+
+	config, err = NewTLSConfig(caFile, certFile, keyFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := getWithTLSConfig(server, config); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewTLSConfigErrors(t *testing.T) {
+	_, certFile, _ := newClientCertificate(t)
+
+	if _, err := NewTLSConfig("", certFile, "", false); err == nil {
+		t.Error("Client certificate is accepted without a key")
+	}
+	if _, err := NewTLSConfig(filepath.Join(t.TempDir(), "missing.pem"), "", "", false); err == nil {
+		t.Error("Missing CA bundle is accepted")
+	}
+	if _, err := NewTLSConfig(writePEM(t, "EC PRIVATE KEY", []byte("key")), "", "", false); err == nil {
+		t.Error("CA bundle without certificates is accepted")
+	}
+}